@@ -0,0 +1,48 @@
+package main
+
+import "encoding/json"
+
+// UnmarshalJSON reads the entry's resourceType before decoding its resource,
+// so the Practitioner and Patient entries a search with _include adds to a
+// page are not mistaken for Encounters. Other resource types, such as an
+// OperationOutcome with search mode outcome, keep only their resourceType.
+func (e *BundleEntry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		FullUrl  string          `json:"fullUrl"`
+		Resource json.RawMessage `json:"resource"`
+	}
+	if err := fastJSON.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*e = BundleEntry{FullUrl: raw.FullUrl}
+	if len(raw.Resource) == 0 {
+		return nil
+	}
+
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := fastJSON.Unmarshal(raw.Resource, &header); err != nil {
+		return err
+	}
+	e.ResourceType = header.ResourceType
+
+	switch header.ResourceType {
+	case "Practitioner":
+		e.Practitioner = new(Practitioner)
+		return fastJSON.Unmarshal(raw.Resource, e.Practitioner)
+	case "Patient":
+		e.Patient = new(Patient)
+		return fastJSON.Unmarshal(raw.Resource, e.Patient)
+	case "Encounter", "":
+		return fastJSON.Unmarshal(raw.Resource, &e.Resource)
+	}
+	return nil
+}
+
+// IsEncounter reports whether the entry is a search match. A resource
+// without resourceType is taken as an Encounter, as before entries were
+// typed.
+func (e BundleEntry) IsEncounter() bool {
+	return e.ResourceType == "Encounter" || e.ResourceType == ""
+}
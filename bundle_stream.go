@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// streamBundlePage decodes a search page token by token, dispatching each
+// entry as soon as it is read instead of materializing the whole Bundle.
+// Only opening the response is retried: once entries have been dispatched a
+// decode failure fails the page, since replaying it would resend them.
+// MAX_RESPONSE_BYTES does not apply here because the page is never buffered.
+func streamBundlePage(ctx context.Context, pageURL string, maxRetries int, dispatch func(BundleEntry)) (bundlePage, error) {
+	resp, base, err := retryFetchFailover(ctx, pageURL, maxRetries, func(ctx context.Context, url string) (*http.Response, error) {
+		return openResponse(ctx, url, cacheValidators{})
+	})
+	if err != nil {
+		return bundlePage{}, err
+	}
+	defer resp.Body.Close()
+	if base == "" {
+		base = activeFHIRBase()
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return bundlePage{}, err
+	}
+
+	var page bundlePage
+	typeChecked := false
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return page, fmt.Errorf("erro ao ler JSON de encontros: %w", err)
+		}
+
+		switch token {
+		case "type":
+			var bundleType string
+			if err := decoder.Decode(&bundleType); err != nil {
+				return page, fmt.Errorf("erro ao ler tipo do Bundle: %w", err)
+			}
+			if err := checkBundleType(bundleType, base); err != nil {
+				return page, err
+			}
+			typeChecked = true
+		case "entry":
+			if !typeChecked {
+				// Servers write type first; a Bundle without it before
+				// its entries is checked as untyped.
+				if err := checkBundleType("", base); err != nil {
+					return page, err
+				}
+				typeChecked = true
+			}
+			if err := expectDelim(decoder, '['); err != nil {
+				return page, err
+			}
+			for decoder.More() {
+				var entry BundleEntry
+				if err := decoder.Decode(&entry); err != nil {
+					return page, fmt.Errorf("erro ao parsear entrada do Bundle: %w", err)
+				}
+				if !entry.IsEncounter() {
+					slog.Debug("Skipping non-Encounter Bundle entry", "fullUrl", entry.FullUrl, "resourceType", entry.ResourceType)
+					continue
+				}
+				page.Entries++
+				entry.Base = base
+				dispatch(entry)
+			}
+			if err := expectDelim(decoder, ']'); err != nil {
+				return page, err
+			}
+		case "total":
+			if err := decoder.Decode(&page.Total); err != nil {
+				return page, fmt.Errorf("erro ao ler total do Bundle: %w", err)
+			}
+		case "link":
+			var bundle Bundle
+			if err := decoder.Decode(&bundle.Link); err != nil {
+				return page, fmt.Errorf("erro ao parsear links do Bundle: %w", err)
+			}
+			page.Next = bundle.NextLink()
+		default:
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return page, fmt.Errorf("erro ao ler JSON de encontros: %w", err)
+			}
+		}
+	}
+
+	return page, nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("erro ao ler JSON de encontros: %w", err)
+	}
+	if token != delim {
+		return fmt.Errorf("erro ao ler JSON de encontros: esperado %q, encontrado %v", delim, token)
+	}
+	return nil
+}
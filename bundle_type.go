@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var errUnexpectedBundleType = errors.New("search returned a Bundle that is not a searchset")
+
+// checkBundleType applies BUNDLE_TYPE_CHECK to a search page before its
+// entries are dispatched. Anything but a searchset means the request reached
+// the wrong endpoint, or an error response happened to decode as a Bundle;
+// warn logs it, fail fails the page.
+func checkBundleType(bundleType string, base string) error {
+	if cfg.BundleTypeCheck == "off" || bundleType == "searchset" {
+		return nil
+	}
+	if cfg.BundleTypeCheck == "fail" {
+		return fmt.Errorf("%w: type %q from %s", errUnexpectedBundleType, bundleType, base)
+	}
+	slog.Warn("Search returned a Bundle that is not a searchset, check the endpoint", "type", bundleType, "base", base)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+type CapabilityStatement struct {
+	ResourceType string `json:"resourceType"`
+	FHIRVersion  string `json:"fhirVersion"`
+	Software     struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"software"`
+	Rest []struct {
+		Resource []struct {
+			Type        string `json:"type"`
+			SearchParam []struct {
+				Name string `json:"name"`
+			} `json:"searchParam"`
+		} `json:"resource"`
+	} `json:"rest"`
+}
+
+// SearchParams returns the search parameters the server declares for a
+// resource type, and whether the type is declared at all.
+func (c CapabilityStatement) SearchParams(resourceType string) ([]string, bool) {
+	var params []string
+	found := false
+	for _, rest := range c.Rest {
+		for _, resource := range rest.Resource {
+			if resource.Type != resourceType {
+				continue
+			}
+			found = true
+			for _, param := range resource.SearchParam {
+				params = append(params, param.Name)
+			}
+		}
+	}
+	return params, found
+}
+
+// requiredSearchParams lists the searches this run will issue, per resource.
+func requiredSearchParams() map[string][]string {
+	required := map[string][]string{}
+	switch cfg.Mode {
+	case "patients":
+		required["Encounter"] = []string{"subject"}
+	default:
+		required["Encounter"] = []string{"date"}
+	}
+	if cfg.ResolvePractitionerRole {
+		required["PractitionerRole"] = []string{"practitioner"}
+	}
+	return required
+}
+
+// checkCapabilities fetches /metadata and verifies that the server declares
+// every search parameter the run depends on. A server that does not declare
+// date on Encounter may silently ignore it and return every encounter for
+// each day.
+func checkCapabilities(ctx context.Context) error {
+	metadataURL := cfg.FHIRBaseURL + "/metadata"
+	data, err := fetchDataWithRetry(ctx, metadataURL, cfg.FetchMaxRetries)
+	if err != nil {
+		return fmt.Errorf("error fetching CapabilityStatement: %w", err)
+	}
+
+	var capability CapabilityStatement
+	if err := json.Unmarshal(data, &capability); err != nil {
+		return fmt.Errorf("error parsing CapabilityStatement: %w", err)
+	}
+	if capability.ResourceType != "CapabilityStatement" {
+		return fmt.Errorf("%s returned %q instead of a CapabilityStatement", metadataURL, capability.ResourceType)
+	}
+
+	var missing []string
+	for resourceType, params := range requiredSearchParams() {
+		declared, found := capability.SearchParams(resourceType)
+		if !found {
+			missing = append(missing, resourceType)
+			continue
+		}
+		for _, param := range params {
+			if !slices.Contains(declared, param) {
+				missing = append(missing, resourceType+"?"+param)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("server does not declare support for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// verifyCapabilities runs checkCapabilities according to CHECK_CAPABILITIES:
+// warn logs a failure and continues, fail stops the run.
+func verifyCapabilities(ctx context.Context) {
+	if cfg.CheckCapabilities == "off" {
+		return
+	}
+
+	err := checkCapabilities(ctx)
+	if err == nil {
+		slog.Info("Server CapabilityStatement supports the required searches")
+		return
+	}
+	if cfg.CheckCapabilities == "fail" {
+		log.Fatalf("Capability check failed: %v", err)
+	}
+	slog.Warn("Capability check failed, continuing", "error", err)
+}
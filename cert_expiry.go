@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certExpiryUnix is the NotAfter of each HTTPS server's certificate, on
+// /debug/vars as fhir_cert_expiry_unix.
+var certExpiryUnix = expvar.NewMap("fhir_cert_expiry_unix")
+
+// checkCertExpiry reads the certificate every HTTPS FHIR server presents
+// and warns when it expires within CERT_EXPIRY_WARNING. The certificate is
+// taken from a request made with the FHIR client itself, so proxies and
+// timeouts apply as in a run. Failing to connect is logged and reported,
+// never fatal: the run itself will show the error.
+func checkCertExpiry(ctx context.Context) error {
+	var failed []string
+	for _, server := range fhirServers {
+		if !strings.HasPrefix(server.Base, "https://") {
+			continue
+		}
+		notAfter, err := serverCertExpiry(ctx, server.Base)
+		if err != nil {
+			slog.Error("Erro ao verificar certificado TLS do servidor FHIR", "base", server.Base, "error", err)
+			failed = append(failed, server.Base)
+			continue
+		}
+		expiry := new(expvar.Int)
+		expiry.Set(notAfter.Unix())
+		certExpiryUnix.Set(server.Base, expiry)
+
+		remaining := time.Until(notAfter)
+		attrs := []any{"base", server.Base, "notAfter", notAfter.Format(time.RFC3339), "remaining", remaining.Round(time.Hour)}
+		if remaining < cfg.CertExpiryWarning {
+			slog.Warn("Certificado TLS do servidor FHIR expira em breve", attrs...)
+		} else {
+			slog.Info("Certificado TLS do servidor FHIR", attrs...)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not read the TLS certificate of %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// serverCertExpiry returns the NotAfter of the leaf certificate base
+// presents, read from a HEAD on its CapabilityStatement.
+func serverCertExpiry(ctx context.Context, base string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base+"/metadata", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := fhirClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return time.Time{}, fmt.Errorf("no TLS certificate presented")
+	}
+	return resp.TLS.PeerCertificates[0].NotAfter, nil
+}
+
+// startCertExpiryCheck repeats checkCertExpiry every CERT_CHECK_INTERVAL,
+// for runs that outlive a certificate (MODE=continuous). The returned
+// function stops it.
+func startCertExpiryCheck(ctx context.Context, interval time.Duration) func() {
+	if cfg.CertExpiryWarning <= 0 || interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				checkCertExpiry(ctx)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
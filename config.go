@@ -0,0 +1,678 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the collector. Values come from defaults,
+// then the optional -config file (YAML or JSON), then environment variables
+// named by the env tag, which always win.
+type Config struct {
+	Mode                string        `yaml:"mode" env:"MODE"`
+	StartDate           string        `yaml:"startDate" env:"START_DATE"`
+	EndDate             string        `yaml:"endDate" env:"END_DATE"`
+	Direction           string        `yaml:"direction" env:"DIRECTION"`
+	CatchupLookbackDays int           `yaml:"catchupLookbackDays" env:"CATCHUP_LOOKBACK_DAYS"`
+	LookbackDays        int           `yaml:"lookbackDays" env:"LOOKBACK_DAYS"`
+	PollInterval        time.Duration `yaml:"pollInterval" env:"POLL_INTERVAL"`
+	PatientIDs          string        `yaml:"patientIds" env:"PATIENT_IDS"`
+	PatientIDsFile      string        `yaml:"patientIdsFile" env:"PATIENT_IDS_FILE"`
+	PatientIDsRedisList string        `yaml:"patientIdsRedisList" env:"PATIENT_IDS_REDIS_LIST"`
+	EncounterURL        string        `yaml:"encounterUrl" env:"ENCOUNTER_URL"`
+	SingleSend          bool          `yaml:"singleSend" env:"SINGLE_SEND"`
+
+	FHIRBaseURL              string        `yaml:"fhirBaseUrl" env:"FHIR_BASE_URL"`
+	FHIRFailoverURLs         string        `yaml:"fhirFailoverUrls" env:"FHIR_FAILOVER_URLS"`
+	FHIRFailoverCooldown     time.Duration `yaml:"fhirFailoverCooldown" env:"FHIR_FAILOVER_COOLDOWN"`
+	FHIRProxyURL             string        `yaml:"fhirProxyUrl" env:"FHIR_PROXY_URL"`
+	HTTPTimeout              time.Duration `yaml:"httpTimeout" env:"HTTP_TIMEOUT"`
+	HTTPDialTimeout          time.Duration `yaml:"httpDialTimeout" env:"HTTP_DIAL_TIMEOUT"`
+	HTTPTLSTimeout           time.Duration `yaml:"httpTlsTimeout" env:"HTTP_TLS_TIMEOUT"`
+	FetchMaxRetries          int           `yaml:"fetchMaxRetries" env:"FETCH_MAX_RETRIES"`
+	MaxResponseBytes         int64         `yaml:"maxResponseBytes" env:"MAX_RESPONSE_BYTES"`
+	StreamingParse           bool          `yaml:"streamingParse" env:"STREAMING_PARSE"`
+	JSONCodec                string        `yaml:"jsonCodec" env:"JSON_CODEC"`
+	SkipDuplicateEntries     bool          `yaml:"skipDuplicateEntries" env:"SKIP_DUPLICATE_ENTRIES"`
+	ResumePagination         bool          `yaml:"resumePagination" env:"RESUME_PAGINATION"`
+	EncounterElements        string        `yaml:"encounterElements" env:"ENCOUNTER_ELEMENTS"`
+	EncounterSummary         string        `yaml:"encounterSummary" env:"ENCOUNTER_SUMMARY"`
+	PractitionerElements     string        `yaml:"practitionerElements" env:"PRACTITIONER_ELEMENTS"`
+	PatientElements          string        `yaml:"patientElements" env:"PATIENT_ELEMENTS"`
+	PaginationStrategy       string        `yaml:"paginationStrategy" env:"PAGINATION_STRATEGY"`
+	SearchSort               string        `yaml:"searchSort" env:"SEARCH_SORT"`
+	CheckCapabilities        string        `yaml:"checkCapabilities" env:"CHECK_CAPABILITIES"`
+	PreferHandling           string        `yaml:"preferHandling" env:"PREFER_HANDLING"`
+	DateGuard                string        `yaml:"dateGuard" env:"DATE_GUARD"`
+	BundleTypeCheck          string        `yaml:"bundleTypeCheck" env:"BUNDLE_TYPE_CHECK"`
+	DateAttribution          string        `yaml:"dateAttribution" env:"DATE_ATTRIBUTION"`
+	EncounterProfile         string        `yaml:"encounterProfile" env:"ENCOUNTER_PROFILE"`
+	EncounterProfileElements string        `yaml:"encounterProfileElements" env:"ENCOUNTER_PROFILE_ELEMENTS"`
+	DateGuardMaxOutside      float64       `yaml:"dateGuardMaxOutside" env:"DATE_GUARD_MAX_OUTSIDE"`
+	PageSize                 int           `yaml:"pageSize" env:"PAGE_SIZE"`
+	MaxPages                 int           `yaml:"maxPages" env:"MAX_PAGES"`
+
+	ConditionalFetch          bool          `yaml:"conditionalFetch" env:"CONDITIONAL_FETCH"`
+	ReferenceCache            bool          `yaml:"referenceCache" env:"REFERENCE_CACHE"`
+	ReferenceCacheTTL         time.Duration `yaml:"referenceCacheTtl" env:"REFERENCE_CACHE_TTL"`
+	WarmUpPractitioners       bool          `yaml:"warmUpPractitioners" env:"WARM_UP_PRACTITIONERS"`
+	WarmUpPageSize            int           `yaml:"warmUpPageSize" env:"WARM_UP_PAGE_SIZE"`
+	EncounterOnly             bool          `yaml:"encounterOnly" env:"ENCOUNTER_ONLY"`
+	ResolvePractitionerRole   bool          `yaml:"resolvePractitionerRole" env:"RESOLVE_PRACTITIONER_ROLE"`
+	ReferenceFetchConcurrency int           `yaml:"referenceFetchConcurrency" env:"REFERENCE_FETCH_CONCURRENCY"`
+
+	PractitionerReferenceTypes string `yaml:"practitionerReferenceTypes" env:"PRACTITIONER_REFERENCE_TYPES"`
+	ParticipantTypePriority    string `yaml:"participantTypePriority" env:"PARTICIPANT_TYPE_PRIORITY"`
+
+	StatusMapping             string        `yaml:"statusMapping" env:"STATUS_MAPPING"`
+	KeepRawStatus             bool          `yaml:"keepRawStatus" env:"KEEP_RAW_STATUS"`
+	GenderOutsideValueSet     string        `yaml:"genderOutsideValueSet" env:"GENDER_OUTSIDE_VALUE_SET"`
+	IncludeStatuses           string        `yaml:"includeStatuses" env:"INCLUDE_STATUSES"`
+	ExcludeStatuses           string        `yaml:"excludeStatuses" env:"EXCLUDE_STATUSES"`
+	IngestEnteredInError      bool          `yaml:"ingestEnteredInError" env:"INGEST_ENTERED_IN_ERROR"`
+	CaptureTelecom            bool          `yaml:"captureTelecom" env:"CAPTURE_TELECOM"`
+	CaptureLastUpdated        bool          `yaml:"captureLastUpdated" env:"CAPTURE_LAST_UPDATED"`
+	PeriodEndBeforeStart      string        `yaml:"periodEndBeforeStart" env:"PERIOD_END_BEFORE_START"`
+	PractitionerMissingFamily string        `yaml:"practitionerMissingFamily" env:"PRACTITIONER_MISSING_FAMILY"`
+	FamilyNamePlaceholder     string        `yaml:"familyNamePlaceholder" env:"FAMILY_NAME_PLACEHOLDER"`
+	MissingReference          string        `yaml:"missingReference" env:"MISSING_REFERENCE"`
+	MinEncounterDuration      time.Duration `yaml:"minEncounterDuration" env:"MIN_ENCOUNTER_DURATION"`
+	PeriodTimezone            string        `yaml:"periodTimezone" env:"PERIOD_TIMEZONE"`
+	KeepPeriodOffset          bool          `yaml:"keepPeriodOffset" env:"KEEP_PERIOD_OFFSET"`
+	StrictEmptyDates          bool          `yaml:"strictEmptyDates" env:"STRICT_EMPTY_DATES"`
+	EmptyDateThreshold        int           `yaml:"emptyDateThreshold" env:"EMPTY_DATE_THRESHOLD"`
+
+	MaxDateAttempts           int           `yaml:"maxDateAttempts" env:"MAX_DATE_ATTEMPTS"`
+	DateFailureCooldown       time.Duration `yaml:"dateFailureCooldown" env:"DATE_FAILURE_COOLDOWN"`
+	DateFailureStreak         int           `yaml:"dateFailureStreak" env:"DATE_FAILURE_STREAK"`
+	DateFailureStreakCooldown time.Duration `yaml:"dateFailureStreakCooldown" env:"DATE_FAILURE_STREAK_COOLDOWN"`
+	FailFast                  bool          `yaml:"failFast" env:"FAIL_FAST"`
+	ExitMaxFailed             int           `yaml:"exitMaxFailed" env:"EXIT_MAX_FAILED"`
+	ExitMaxInvalidRate        float64       `yaml:"exitMaxInvalidRate" env:"EXIT_MAX_INVALID_RATE"`
+	AbortInvalidRate          float64       `yaml:"abortInvalidRate" env:"ABORT_INVALID_RATE"`
+	AbortInvalidMinSeen       int           `yaml:"abortInvalidMinSeen" env:"ABORT_INVALID_MIN_SEEN"`
+	BatchDays                 int           `yaml:"batchDays" env:"BATCH_DAYS"`
+	PrefetchNextDate          bool          `yaml:"prefetchNextDate" env:"PREFETCH_NEXT_DATE"`
+	CursorCommitEvery         int           `yaml:"cursorCommitEvery" env:"CURSOR_COMMIT_EVERY"`
+	CursorCommitInterval      time.Duration `yaml:"cursorCommitInterval" env:"CURSOR_COMMIT_INTERVAL"`
+	MaxRuntime                time.Duration `yaml:"maxRuntime" env:"MAX_RUNTIME"`
+	RunDeadline               string        `yaml:"runDeadline" env:"RUN_DEADLINE"`
+
+	Sinks              string        `yaml:"sinks" env:"SINKS"`
+	MessageFormat      string        `yaml:"messageFormat" env:"MESSAGE_FORMAT"`
+	OutputTemplate     string        `yaml:"outputTemplate" env:"OUTPUT_TEMPLATE"`
+	MessageSchema      string        `yaml:"messageSchema" env:"MESSAGE_SCHEMA"`
+	IncludeSource      bool          `yaml:"includeSource" env:"INCLUDE_SOURCE"`
+	DedupReferences    bool          `yaml:"dedupReferences" env:"DEDUP_REFERENCES"`
+	DedupTTL           time.Duration `yaml:"dedupTtl" env:"DEDUP_TTL"`
+	RunID              string        `yaml:"runId" env:"RUN_ID"`
+	OutputDir          string        `yaml:"outputDir" env:"OUTPUT_DIR"`
+	SQSQueueURL        string        `yaml:"sqsQueueUrl" env:"SQS_QUEUE_URL"`
+	SQSRegion          string        `yaml:"sqsRegion" env:"SQS_REGION"`
+	SQSEndpoint        string        `yaml:"sqsEndpoint" env:"SQS_ENDPOINT"`
+	ClientPartitions   int           `yaml:"clientPartitions" env:"CLIENT_PARTITIONS"`
+	SQSSenders         int           `yaml:"sqsSenders" env:"SQS_SENDERS"`
+	SQSSendTimeout     time.Duration `yaml:"sqsSendTimeout" env:"SQS_SEND_TIMEOUT"`
+	SQSCompression     bool          `yaml:"sqsCompression" env:"SQS_COMPRESSION"`
+	DateCompleteMarker bool          `yaml:"dateCompleteMarker" env:"DATE_COMPLETE_MARKER"`
+	Journal            string        `yaml:"journal" env:"JOURNAL"`
+	JournalStream      string        `yaml:"journalStream" env:"JOURNAL_STREAM"`
+	JournalFile        string        `yaml:"journalFile" env:"JOURNAL_FILE"`
+	ErrorEvents        string        `yaml:"errorEvents" env:"ERROR_EVENTS"`
+	ErrorStream        string        `yaml:"errorStream" env:"ERROR_STREAM"`
+	ErrorEventsFile    string        `yaml:"errorEventsFile" env:"ERROR_EVENTS_FILE"`
+
+	PartitionBy         string `yaml:"partitionBy" env:"PARTITION_BY"`
+	OrganizationClients string `yaml:"organizationClients" env:"ORGANIZATION_CLIENTS"`
+	DefaultClientID     string `yaml:"defaultClientId" env:"DEFAULT_CLIENT_ID"`
+
+	StateStore     string `yaml:"stateStore" env:"STATE_STORE"`
+	StateDir       string `yaml:"stateDir" env:"STATE_DIR"`
+	ReadOnly       bool   `yaml:"readOnly" env:"READONLY"`
+	ValkeyURI      string `yaml:"valkeyUri" env:"VALKEY_URI"`
+	ValkeyPassword string `yaml:"valkeyPassword" env:"VALKEY_PWD" secret:"true"`
+
+	RedisMaxAttempts  int           `yaml:"redisMaxAttempts" env:"REDIS_MAX_ATTEMPTS"`
+	RedisRetryBackoff time.Duration `yaml:"redisRetryBackoff" env:"REDIS_RETRY_BACKOFF"`
+	RedisPoolSize     int           `yaml:"redisPoolSize" env:"REDIS_POOL_SIZE"`
+	RedisPoolTimeout  time.Duration `yaml:"redisPoolTimeout" env:"REDIS_POOL_TIMEOUT"`
+
+	RunLock  bool          `yaml:"runLock" env:"RUN_LOCK"`
+	LockKey  string        `yaml:"lockKey" env:"LOCK_KEY"`
+	LockTTL  time.Duration `yaml:"lockTtl" env:"LOCK_TTL"`
+	LockWait time.Duration `yaml:"lockWait" env:"LOCK_WAIT"`
+
+	LogLevel          string        `yaml:"logLevel" env:"LOG_LEVEL"`
+	LogStdoutOnly     bool          `yaml:"logStdoutOnly" env:"LOG_STDOUT_ONLY"`
+	LogDir            string        `yaml:"logDir" env:"LOG_DIR"`
+	LogFilePattern    string        `yaml:"logFilePattern" env:"LOG_FILE_PATTERN"`
+	LogRotationTime   time.Duration `yaml:"logRotationTime" env:"LOG_ROTATION_TIME"`
+	LogMaxAge         time.Duration `yaml:"logMaxAge" env:"LOG_MAX_AGE"`
+	LogMaxSizeMB      int           `yaml:"logMaxSizeMb" env:"LOG_MAX_SIZE_MB"`
+	MetricsAddr       string        `yaml:"metricsAddr" env:"METRICS_ADDR"`
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval" env:"HEARTBEAT_INTERVAL"`
+	CertExpiryWarning time.Duration `yaml:"certExpiryWarning" env:"CERT_EXPIRY_WARNING"`
+	CertCheckInterval time.Duration `yaml:"certCheckInterval" env:"CERT_CHECK_INTERVAL"`
+	StallTimeout      time.Duration `yaml:"stallTimeout" env:"STALL_TIMEOUT"`
+	StallAction       string        `yaml:"stallAction" env:"STALL_ACTION"`
+	StatsFile         string        `yaml:"statsFile" env:"STATS_FILE"`
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Mode:                       "backfill",
+		CatchupLookbackDays:        1,
+		FHIRBaseURL:                "https://hapi.fhir.org/baseR4",
+		FHIRFailoverCooldown:       5 * time.Minute,
+		StallAction:                "warn",
+		PollInterval:               5 * time.Minute,
+		CertCheckInterval:          24 * time.Hour,
+		Direction:                  "asc",
+		RedisPoolTimeout:           5 * time.Second,
+		HTTPTimeout:                20 * time.Second,
+		HTTPDialTimeout:            30 * time.Second,
+		HTTPTLSTimeout:             10 * time.Second,
+		FetchMaxRetries:            3,
+		MaxResponseBytes:           50 * 1024 * 1024,
+		PaginationStrategy:         paginationNext,
+		SearchSort:                 "_lastUpdated",
+		CheckCapabilities:          "off",
+		DateGuard:                  "warn",
+		BundleTypeCheck:            "warn",
+		DateAttribution:            "off",
+		DateGuardMaxOutside:        0.5,
+		PractitionerReferenceTypes: "Practitioner",
+		PageSize:                   50,
+		WarmUpPageSize:             1000,
+		PeriodEndBeforeStart:       "drop_end",
+		PractitionerMissingFamily:  "allow",
+		GenderOutsideValueSet:      "unknown",
+		FamilyNamePlaceholder:      "-",
+		MissingReference:           "invalidate",
+		EmptyDateThreshold:         50,
+		MaxDateAttempts:            3,
+		DateFailureStreak:          3,
+		BatchDays:                  1,
+		CursorCommitEvery:          1,
+		Sinks:                      "sqs",
+		MessageFormat:              "combined",
+		DedupTTL:                   24 * time.Hour,
+		OutputDir:                  "output",
+		SQSRegion:                  "sa-east-1",
+		SQSEndpoint:                "http://localstack:4566",
+		SQSSendTimeout:             30 * time.Second,
+		ClientPartitions:           2,
+		PartitionBy:                "patient",
+		JournalStream:              "sent_journal",
+		JournalFile:                "output/sent_journal.ndjson",
+		ErrorStream:                "error_events",
+		ErrorEventsFile:            "output/error_events.ndjson",
+		RedisMaxAttempts:           5,
+		RedisRetryBackoff:          200 * time.Millisecond,
+		RunLock:                    true,
+		SkipDuplicateEntries:       true,
+		StateStore:                 "redis",
+		StateDir:                   "state",
+		JSONCodec:                  "std",
+		ExitMaxInvalidRate:         1,
+		AbortInvalidMinSeen:        100,
+		LockTTL:                    time.Minute,
+		LogLevel:                   "info",
+		LogDir:                     "/app/logs",
+		LogFilePattern:             "logs/collector.%Y-%m-%d.log",
+		LogRotationTime:            24 * time.Hour,
+		LogMaxAge:                  72 * time.Hour,
+	}
+}
+
+func loadConfig(path string) (Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("error reading config file: %w", err)
+		}
+		// YAML is a superset of JSON, so the same decoder reads both formats.
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnvOverrides(&config); err != nil {
+		return config, err
+	}
+
+	config.EncounterElements = mergeElements(config.EncounterElements, "status,class,type,period,participant,subject,serviceProvider")
+	if config.LookbackDays > 0 || config.CaptureLastUpdated {
+		config.EncounterElements = mergeElements(config.EncounterElements, "meta")
+	}
+	if profileElements := profileElementsToRequest(config.EncounterProfile, config.EncounterProfileElementList()); profileElements != "" {
+		config.EncounterElements = mergeElements(config.EncounterElements, profileElements)
+	}
+	practitionerFields := "name,qualification"
+	patientFields := "name,birthDate,gender,managingOrganization,address,deceased"
+	if config.CaptureTelecom {
+		patientFields += ",telecom"
+	}
+	if config.CaptureLastUpdated {
+		practitionerFields += ",meta"
+		patientFields += ",meta"
+	}
+	config.PractitionerElements = mergeElements(config.PractitionerElements, practitionerFields)
+	config.PatientElements = mergeElements(config.PatientElements, patientFields)
+	config.FHIRBaseURL = strings.TrimRight(config.FHIRBaseURL, "/")
+	if config.LockKey == "" {
+		config.LockKey = defaultLockKey(config)
+	}
+
+	return config, config.Validate()
+}
+
+func applyEnvOverrides(config *Config) error {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		envValue := os.Getenv(field.Tag.Get("env"))
+		if envValue == "" {
+			continue
+		}
+
+		target := value.Field(i)
+		switch {
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			parsed, err := time.ParseDuration(envValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %q: %w", field.Tag.Get("env"), envValue, err)
+			}
+			target.SetInt(int64(parsed))
+		case field.Type.Kind() == reflect.String:
+			target.SetString(envValue)
+		case field.Type.Kind() == reflect.Bool:
+			parsed, err := strconv.ParseBool(envValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %q: %w", field.Tag.Get("env"), envValue, err)
+			}
+			target.SetBool(parsed)
+		case field.Type.Kind() == reflect.Float64:
+			parsed, err := strconv.ParseFloat(envValue, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %q: %w", field.Tag.Get("env"), envValue, err)
+			}
+			target.SetFloat(parsed)
+		case field.Type.Kind() == reflect.Int || field.Type.Kind() == reflect.Int64:
+			parsed, err := strconv.ParseInt(envValue, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s value %q: %w", field.Tag.Get("env"), envValue, err)
+			}
+			target.SetInt(parsed)
+		}
+	}
+	return nil
+}
+
+// Validate checks the whole configuration at once and reports every problem.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	switch c.Mode {
+	case "backfill":
+		_, startErr := time.Parse("2006-01-02", c.StartDate)
+		_, endErr := time.Parse("2006-01-02", c.EndDate)
+		check(startErr == nil, "START_DATE must be a YYYY-MM-DD date, got %q", c.StartDate)
+		check(endErr == nil, "END_DATE must be a YYYY-MM-DD date, got %q", c.EndDate)
+	case "catchup":
+		check(c.CatchupLookbackDays >= 1, "CATCHUP_LOOKBACK_DAYS must be at least 1, got %d", c.CatchupLookbackDays)
+		check(c.LookbackDays >= 0, "LOOKBACK_DAYS must not be negative, got %d", c.LookbackDays)
+	case "continuous":
+		check(c.CatchupLookbackDays >= 1, "CATCHUP_LOOKBACK_DAYS must be at least 1, got %d", c.CatchupLookbackDays)
+		check(c.PollInterval > 0, "POLL_INTERVAL must be positive, got %s", c.PollInterval)
+		check(c.LookbackDays >= 0, "LOOKBACK_DAYS must not be negative, got %d", c.LookbackDays)
+	case "patients":
+		check(c.PatientIDs != "" || c.PatientIDsFile != "" || c.PatientIDsRedisList != "",
+			"MODE=patients requires PATIENT_IDS, PATIENT_IDS_FILE or PATIENT_IDS_REDIS_LIST")
+	case "preflight":
+	case "single":
+		check(c.EncounterURL != "", "MODE=single requires -url or ENCOUNTER_URL")
+	default:
+		errs = append(errs, fmt.Errorf("unknown MODE %q, expected backfill, catchup, continuous, patients, preflight or single", c.Mode))
+	}
+
+	baseURL, err := url.Parse(c.FHIRBaseURL)
+	check(err == nil && baseURL.Scheme != "" && baseURL.Host != "", "FHIR_BASE_URL must be an absolute URL, got %q", c.FHIRBaseURL)
+	for _, base := range splitList(c.FHIRFailoverURLs) {
+		failoverURL, err := url.Parse(base)
+		check(err == nil && failoverURL.Scheme != "" && failoverURL.Host != "", "FHIR_FAILOVER_URLS entries must be absolute URLs")
+	}
+	check(c.FHIRFailoverCooldown > 0, "FHIR_FAILOVER_COOLDOWN must be positive, got %s", c.FHIRFailoverCooldown)
+	check(c.HTTPTimeout > 0, "HTTP_TIMEOUT must be positive, got %s", c.HTTPTimeout)
+	check(c.HTTPDialTimeout > 0, "HTTP_DIAL_TIMEOUT must be positive, got %s", c.HTTPDialTimeout)
+	check(c.HTTPTLSTimeout > 0, "HTTP_TLS_TIMEOUT must be positive, got %s", c.HTTPTLSTimeout)
+	for _, proxy := range []struct{ name, value string }{
+		{"FHIR_PROXY_URL", c.FHIRProxyURL},
+		{"HTTP_PROXY", os.Getenv("HTTP_PROXY")},
+		{"HTTPS_PROXY", os.Getenv("HTTPS_PROXY")},
+	} {
+		if proxy.value == "" {
+			continue
+		}
+		proxyURL, err := url.Parse(proxy.value)
+		check(err == nil && proxyURL.Scheme != "" && proxyURL.Host != "", "%s must be an absolute URL such as http://proxy:3128", proxy.name)
+	}
+	check(c.FetchMaxRetries >= 1, "FETCH_MAX_RETRIES must be at least 1, got %d", c.FetchMaxRetries)
+	check(c.MaxResponseBytes >= 1, "MAX_RESPONSE_BYTES must be positive, got %d", c.MaxResponseBytes)
+	check(c.PageSize >= 1, "PAGE_SIZE must be at least 1, got %d", c.PageSize)
+	check(!c.WarmUpPractitioners || c.ReferenceCache, "WARM_UP_PRACTITIONERS requires REFERENCE_CACHE")
+	check(c.WarmUpPageSize >= 1, "WARM_UP_PAGE_SIZE must be at least 1, got %d", c.WarmUpPageSize)
+	check(c.MaxPages >= 0, "MAX_PAGES must not be negative, got %d", c.MaxPages)
+	check(c.SearchSort != "", "SEARCH_SORT must not be empty, use none to disable sorting")
+	switch c.PaginationStrategy {
+	case paginationNext, paginationOffset, paginationAuto:
+	default:
+		errs = append(errs, fmt.Errorf("unknown PAGINATION_STRATEGY %q, expected next, offset or auto", c.PaginationStrategy))
+	}
+
+	check(len(c.PractitionerReferenceTypeList()) > 0, "PRACTITIONER_REFERENCE_TYPES must list at least one resource type")
+	if _, err := parseStatusMapping(c.StatusMapping); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.CheckCapabilities {
+	case "off", "warn", "fail":
+	default:
+		errs = append(errs, fmt.Errorf("unknown CHECK_CAPABILITIES %q, expected off, warn or fail", c.CheckCapabilities))
+	}
+	switch c.DateGuard {
+	case "off", "warn", "abort":
+	default:
+		errs = append(errs, fmt.Errorf("unknown DATE_GUARD %q, expected off, warn or abort", c.DateGuard))
+	}
+	switch c.BundleTypeCheck {
+	case "off", "warn", "fail":
+	default:
+		errs = append(errs, fmt.Errorf("unknown BUNDLE_TYPE_CHECK %q, expected off, warn or fail", c.BundleTypeCheck))
+	}
+	switch c.DateAttribution {
+	case "off", "start":
+	default:
+		errs = append(errs, fmt.Errorf("unknown DATE_ATTRIBUTION %q, expected off or start", c.DateAttribution))
+	}
+	check(c.DateGuardMaxOutside >= 0 && c.DateGuardMaxOutside < 1, "DATE_GUARD_MAX_OUTSIDE must be in [0, 1), got %v", c.DateGuardMaxOutside)
+	switch c.PreferHandling {
+	case "", "strict", "lenient":
+	default:
+		errs = append(errs, fmt.Errorf("unknown PREFER_HANDLING %q, expected strict or lenient", c.PreferHandling))
+	}
+
+	if err := validateStatusList("INCLUDE_STATUSES", c.IncludeStatusList()); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateStatusList("EXCLUDE_STATUSES", c.ExcludeStatusList()); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.Direction {
+	case "asc":
+	case "desc":
+		check(c.Mode == "backfill", "DIRECTION=desc requires MODE=backfill")
+	default:
+		errs = append(errs, fmt.Errorf("unknown DIRECTION %q, expected asc or desc", c.Direction))
+	}
+	switch c.GenderOutsideValueSet {
+	case "unknown", "flag", "keep":
+	default:
+		errs = append(errs, fmt.Errorf("unknown GENDER_OUTSIDE_VALUE_SET %q, expected unknown, flag or keep", c.GenderOutsideValueSet))
+	}
+	switch c.PractitionerMissingFamily {
+	case "allow", "invalidate":
+	case "placeholder":
+		check(c.FamilyNamePlaceholder != "", "PRACTITIONER_MISSING_FAMILY=placeholder requires FAMILY_NAME_PLACEHOLDER")
+	default:
+		errs = append(errs, fmt.Errorf("unknown PRACTITIONER_MISSING_FAMILY %q, expected allow, invalidate or placeholder", c.PractitionerMissingFamily))
+	}
+	switch c.PeriodEndBeforeStart {
+	case "drop_end", "flag", "invalidate":
+	default:
+		errs = append(errs, fmt.Errorf("unknown PERIOD_END_BEFORE_START %q, expected drop_end, flag or invalidate", c.PeriodEndBeforeStart))
+	}
+	switch c.StateStore {
+	case "redis":
+	case "file":
+		// Only the cursor and the tracking sets have a file implementation.
+		check(!c.RunLock, "STATE_STORE=file requires RUN_LOCK=false")
+		check(!c.ReferenceCache && !c.ConditionalFetch && !c.DedupReferences && !c.ResumePagination,
+			"STATE_STORE=file cannot be combined with REFERENCE_CACHE, CONDITIONAL_FETCH, DEDUP_REFERENCES or RESUME_PAGINATION, which need Redis")
+		check(c.Journal != "redis", "STATE_STORE=file cannot be combined with JOURNAL=redis")
+		check(c.ErrorEvents != "redis", "STATE_STORE=file cannot be combined with ERROR_EVENTS=redis")
+		check(c.LookbackDays == 0, "STATE_STORE=file cannot be combined with LOOKBACK_DAYS, which records sent versions in Redis")
+		check(c.DateAttribution != "start", "STATE_STORE=file cannot be combined with DATE_ATTRIBUTION=start, which records attributions in Redis")
+		check(c.PatientIDsRedisList == "", "STATE_STORE=file cannot be combined with PATIENT_IDS_REDIS_LIST")
+	default:
+		errs = append(errs, fmt.Errorf("unknown STATE_STORE %q, expected redis or file", c.StateStore))
+	}
+	switch c.JSONCodec {
+	case "std", "jsoniter":
+	default:
+		errs = append(errs, fmt.Errorf("unknown JSON_CODEC %q, expected std or jsoniter", c.JSONCodec))
+	}
+	switch c.EncounterSummary {
+	case "", "true", "data":
+	default:
+		errs = append(errs, fmt.Errorf("unknown ENCOUNTER_SUMMARY %q, expected true or data", c.EncounterSummary))
+	}
+	check(c.EncounterSummary == "" || c.EncounterElements == "", "ENCOUNTER_SUMMARY and ENCOUNTER_ELEMENTS cannot be combined")
+	check(c.MinEncounterDuration >= 0, "MIN_ENCOUNTER_DURATION must not be negative")
+	check(c.RedisPoolSize >= 0, "REDIS_POOL_SIZE must not be negative, got %d", c.RedisPoolSize)
+	check(c.RedisPoolTimeout > 0, "REDIS_POOL_TIMEOUT must be positive, got %s", c.RedisPoolTimeout)
+	check(c.HeartbeatInterval >= 0, "HEARTBEAT_INTERVAL must not be negative, got %s", c.HeartbeatInterval)
+	check(c.CertExpiryWarning >= 0, "CERT_EXPIRY_WARNING must not be negative, got %s", c.CertExpiryWarning)
+	check(c.CertCheckInterval >= 0, "CERT_CHECK_INTERVAL must not be negative, got %s", c.CertCheckInterval)
+	check(c.StallTimeout >= 0, "STALL_TIMEOUT must not be negative, got %s", c.StallTimeout)
+	switch c.StallAction {
+	case "warn", "retry":
+	default:
+		errs = append(errs, fmt.Errorf("unknown STALL_ACTION %q, expected warn or retry", c.StallAction))
+	}
+	if c.PeriodTimezone != "" {
+		_, err := time.LoadLocation(c.PeriodTimezone)
+		check(err == nil, "PERIOD_TIMEZONE must be an IANA zone name such as UTC or America/Sao_Paulo, got %q", c.PeriodTimezone)
+	}
+	check(!c.KeepPeriodOffset || c.PeriodTimezone != "", "KEEP_PERIOD_OFFSET requires PERIOD_TIMEZONE")
+	switch c.MissingReference {
+	case "invalidate", "skip":
+	default:
+		errs = append(errs, fmt.Errorf("unknown MISSING_REFERENCE %q, expected invalidate or skip", c.MissingReference))
+	}
+
+	check(c.MaxDateAttempts >= 1, "MAX_DATE_ATTEMPTS must be at least 1, got %d", c.MaxDateAttempts)
+	check(c.DateFailureCooldown >= 0, "DATE_FAILURE_COOLDOWN must not be negative, got %s", c.DateFailureCooldown)
+	check(c.DateFailureStreak >= 1, "DATE_FAILURE_STREAK must be at least 1, got %d", c.DateFailureStreak)
+	check(c.DateFailureStreakCooldown >= 0, "DATE_FAILURE_STREAK_COOLDOWN must not be negative, got %s", c.DateFailureStreakCooldown)
+	check(c.ExitMaxFailed >= 0, "EXIT_MAX_FAILED must not be negative, got %d", c.ExitMaxFailed)
+	check(c.AbortInvalidRate >= 0 && c.AbortInvalidRate <= 1, "ABORT_INVALID_RATE must be between 0 and 1, got %v", c.AbortInvalidRate)
+	check(c.AbortInvalidMinSeen >= 1, "ABORT_INVALID_MIN_SEEN must be at least 1, got %d", c.AbortInvalidMinSeen)
+	check(c.ExitMaxInvalidRate >= 0 && c.ExitMaxInvalidRate <= 1, "EXIT_MAX_INVALID_RATE must be between 0 and 1, got %v", c.ExitMaxInvalidRate)
+	check(c.BatchDays >= 1, "BATCH_DAYS must be at least 1, got %d", c.BatchDays)
+	check(c.CursorCommitEvery >= 1, "CURSOR_COMMIT_EVERY must be at least 1, got %d", c.CursorCommitEvery)
+	check(c.CursorCommitInterval >= 0, "CURSOR_COMMIT_INTERVAL must not be negative")
+	check(c.MaxRuntime >= 0, "MAX_RUNTIME must not be negative")
+	if c.RunDeadline != "" {
+		_, err := time.Parse(time.RFC3339, c.RunDeadline)
+		check(err == nil, "RUN_DEADLINE must be RFC3339, got %q", c.RunDeadline)
+	}
+
+	for _, sink := range strings.Split(c.Sinks, ",") {
+		switch strings.TrimSpace(sink) {
+		case "sqs":
+			check(c.SQSQueueURL != "", "SQS_QUEUE_URL is required when the sqs sink is enabled")
+		case "ndjson":
+		default:
+			errs = append(errs, fmt.Errorf("unknown sink in SINKS: %q", sink))
+		}
+	}
+	check(c.ReferenceFetchConcurrency >= 0, "REFERENCE_FETCH_CONCURRENCY must not be negative, got %d", c.ReferenceFetchConcurrency)
+	check(c.RedisMaxAttempts >= 1, "REDIS_MAX_ATTEMPTS must be at least 1, got %d", c.RedisMaxAttempts)
+	check(c.RedisRetryBackoff >= 0, "REDIS_RETRY_BACKOFF must not be negative")
+	if c.RunLock {
+		check(c.LockKey != "", "LOCK_KEY must not be empty when RUN_LOCK is on")
+		check(c.LockTTL >= 3*time.Second, "LOCK_TTL must be at least 3s, got %s", c.LockTTL)
+		check(c.LockWait >= 0, "LOCK_WAIT must not be negative")
+	}
+	switch c.MessageFormat {
+	case "combined", "split":
+	case "patient":
+		// Encounters wait for the end of their window, so a resumed page
+		// could skip encounters that were never sent.
+		check(!c.ResumePagination, "MESSAGE_FORMAT=patient cannot be combined with RESUME_PAGINATION")
+		check(!c.DedupReferences, "MESSAGE_FORMAT=patient cannot be combined with DEDUP_REFERENCES, each patient is already sent once per window")
+	default:
+		errs = append(errs, fmt.Errorf("unknown MESSAGE_FORMAT %q, expected combined, split or patient", c.MessageFormat))
+	}
+	check(c.OutputTemplate == "" || c.MessageFormat == "combined", "OUTPUT_TEMPLATE requires MESSAGE_FORMAT=combined")
+	check(c.DedupTTL >= 0, "DEDUP_TTL must not be negative")
+	check(c.SQSSenders >= 0, "SQS_SENDERS must not be negative, got %d", c.SQSSenders)
+	check(c.SQSSendTimeout >= 0, "SQS_SEND_TIMEOUT must not be negative, got %s", c.SQSSendTimeout)
+	switch c.Journal {
+	case "", "redis", "file":
+	default:
+		errs = append(errs, fmt.Errorf("unknown JOURNAL %q, expected redis or file", c.Journal))
+	}
+	switch c.ErrorEvents {
+	case "", "redis", "file":
+	default:
+		errs = append(errs, fmt.Errorf("unknown ERROR_EVENTS %q, expected redis or file", c.ErrorEvents))
+	}
+	switch c.PartitionBy {
+	case "patient", "organization":
+	default:
+		errs = append(errs, fmt.Errorf("unknown PARTITION_BY %q, expected patient or organization", c.PartitionBy))
+	}
+	if _, err := parseOrganizationClients(c.OrganizationClients); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.ClientPartitions >= 1, "CLIENT_PARTITIONS must be at least 1, got %d", c.ClientPartitions)
+
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("invalid LOG_LEVEL %q, expected debug, info, warn or error", c.LogLevel))
+	}
+	check(c.LogRotationTime > 0, "LOG_ROTATION_TIME must be positive")
+	check(c.LogMaxAge > 0, "LOG_MAX_AGE must be positive")
+
+	return errors.Join(errs...)
+}
+
+func (c Config) PractitionerReferenceTypeList() []string {
+	return splitList(c.PractitionerReferenceTypes)
+}
+
+func (c Config) EncounterProfileElementList() []string {
+	return splitList(c.EncounterProfileElements)
+}
+
+func (c Config) ParticipantTypePriorityList() []string {
+	return splitList(c.ParticipantTypePriority)
+}
+
+func (c Config) IncludeStatusList() []string {
+	return splitList(c.IncludeStatuses)
+}
+
+func (c Config) ExcludeStatusList() []string {
+	return splitList(c.ExcludeStatuses)
+}
+
+func (c Config) SinkEnabled(name string) bool {
+	for _, sink := range strings.Split(c.Sinks, ",") {
+		if strings.TrimSpace(sink) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logEffectiveConfig logs every setting, masking secrets and URL credentials.
+func logEffectiveConfig(c Config) {
+	value := reflect.ValueOf(c)
+	attrs := make([]any, 0, value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		attrs = append(attrs, slog.Any(field.Tag.Get("env"), redactValue(field, value.Field(i).Interface())))
+	}
+	slog.Info("Effective configuration", attrs...)
+}
+
+func redactValue(field reflect.StructField, value any) any {
+	text, ok := value.(string)
+	if !ok || text == "" {
+		return value
+	}
+	if field.Tag.Get("secret") == "true" {
+		return "[REDACTED]"
+	}
+	if strings.Contains(text, ",") {
+		items := strings.Split(text, ",")
+		for i, item := range items {
+			items[i] = fmt.Sprint(redactValue(field, item))
+		}
+		return strings.Join(items, ",")
+	}
+	if parsed, err := url.Parse(text); err == nil && parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+			return parsed.String()
+		}
+	}
+	return value
+}
+
+// redactSecretFields returns a copy of v for logging with every non-empty
+// string field tagged secret:"true", at any depth, replaced by [REDACTED].
+func redactSecretFields[T any](v T) T {
+	redactStruct(reflect.ValueOf(&v).Elem())
+	return v
+}
+
+func redactStruct(value reflect.Value) {
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldValue := value.Field(i)
+		if field.Tag.Get("secret") == "true" && fieldValue.Kind() == reflect.String && fieldValue.String() != "" {
+			fieldValue.SetString("[REDACTED]")
+			continue
+		}
+		redactStruct(fieldValue)
+	}
+}
+
+// splitList splits a comma-separated setting, dropping blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
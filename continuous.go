@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// runContinuous (MODE=continuous) catches up on past dates like
+// MODE=catchup and then, every POLL_INTERVAL, searches for encounters
+// created or updated since the previous poll (_lastUpdated), until the run
+// deadline or an abort. The last_sync_time cursor records the end of the
+// last successful poll, so a restart picks up where it stopped. With
+// CERT_EXPIRY_WARNING the FHIR certificates are checked again every
+// CERT_CHECK_INTERVAL.
+func runContinuous(ctx context.Context) {
+	stopCertCheck := startCertExpiryCheck(ctx, cfg.CertCheckInterval)
+	defer stopCertCheck()
+
+	currentDate, endDate := catchupRange(ctx)
+	runDateRange(ctx, currentDate, endDate, processDate)
+	runLookback(ctx)
+	if runAborted() != nil {
+		return
+	}
+
+	since := loadSyncCursor(ctx)
+	for {
+		if deadlineReached() {
+			slog.Warn("Run deadline reached, stopping polling", "deadline", runDeadline)
+			return
+		}
+
+		until := time.Now().UTC().Truncate(time.Second)
+		if err := pollUpdates(ctx, since, until); err != nil {
+			slog.Error("Erro ao buscar encontros atualizados, tentando de novo no próximo intervalo", "since", since, "error", err)
+			if abortOnFatal(err) {
+				return
+			}
+		} else {
+			since = until
+			saveSyncCursor(ctx, until)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(until.Add(cfg.PollInterval))):
+		}
+	}
+}
+
+// pollUpdates processes every encounter whose meta.lastUpdated falls in
+// (since, until].
+func pollUpdates(ctx context.Context, since time.Time, until time.Time) error {
+	label := "updated-" + until.Format("20060102T150405Z")
+	slog.Info("Polling updated encounters", "since", since.Format(time.RFC3339), "until", until.Format(time.RFC3339))
+	processingDate.Set(label)
+	ctx, endWatch := watchdog.Begin(ctx, label)
+	defer endWatch()
+
+	url := encounterSearchURL(fmt.Sprintf("%s/Encounter?_lastUpdated=gt%s&_lastUpdated=le%s",
+		activeFHIRBase(), since.Format(time.RFC3339), until.Format(time.RFC3339)))
+
+	var out *ndjsonWriter
+	if ndjsonSinkEnabled {
+		var err error
+		out, err = openNDJSONWriter(label)
+		if err != nil {
+			return fmt.Errorf("falha ao abrir arquivo NDJSON: %w", err)
+		}
+	}
+	result, err := processEncounterSearch(ctx, url, out, nil, nil)
+	if out != nil {
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("falha ao finalizar arquivo NDJSON: %w", closeErr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	stats.update(func(s *runStats) { s.Polls++ })
+	slog.Info("Poll finished", "encounters", result.Entries, "pages", result.Pages)
+	return nil
+}
+
+// loadSyncCursor returns the end of the last successful poll or, on the
+// first run, the start of today, the first day the catch-up did not cover.
+func loadSyncCursor(ctx context.Context) time.Time {
+	value, err := state.GetCursor(ctx, "last_sync_time")
+	if err != nil {
+		slog.Error("Error reading last_sync_time, polling from the start of today", "error", err)
+	}
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since
+	}
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// saveSyncCursor stores the end of a successful poll. Once a poll reaches a
+// new day, every encounter of the previous one was seen, so the date cursor
+// moves to it and a restart does not catch up on it again.
+func saveSyncCursor(ctx context.Context, until time.Time) {
+	if err := state.SetCursor(ctx, "last_sync_time", until.Format(time.RFC3339)); err != nil {
+		slog.Error("Error updating last_sync_time", "error", err)
+	}
+	yesterday := until.Truncate(24 * time.Hour).Add(-24 * time.Hour).Format("2006-01-02")
+	if err := state.SetCursor(ctx, "last_processed_date", yesterday); err != nil {
+		slog.Error("Error updating last processed date", "error", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// cursorCommitter batches writes of the date cursor, last_processed_date or,
+// with DIRECTION=desc, oldest_processed_date. Advance is only
+// called once a date is complete, so the stored cursor never gets ahead of
+// the work actually done; at worst a crash replays the uncommitted dates.
+type cursorCommitter struct {
+	name       string
+	every      int
+	interval   time.Duration
+	pending    string
+	sinceWrite int
+	lastWrite  time.Time
+}
+
+func newCursorCommitter(name string, every int, interval time.Duration) *cursorCommitter {
+	return &cursorCommitter{name: name, every: every, interval: interval, lastWrite: time.Now()}
+}
+
+func (c *cursorCommitter) Advance(ctx context.Context, date string) {
+	c.pending = date
+	c.sinceWrite++
+
+	if c.sinceWrite >= c.every || (c.interval > 0 && time.Since(c.lastWrite) >= c.interval) {
+		c.Flush(ctx)
+	}
+}
+
+func (c *cursorCommitter) Flush(ctx context.Context) {
+	if c.pending == "" {
+		return
+	}
+
+	if err := state.SetCursor(ctx, c.name, c.pending); err != nil {
+		slog.Error("Error updating "+c.name, "store", cfg.StateStore, "error", err)
+		return
+	}
+	slog.Debug("Cursor committed", "date", c.pending)
+	c.pending = ""
+	c.sinceWrite = 0
+	c.lastWrite = time.Now()
+}
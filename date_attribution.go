@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// attributionWindow is the window processDate is running, consulted by
+// DATE_ATTRIBUTION; nil outside a date search (MODE=single, the lookback
+// re-query). Dates run one at a time, so a single value is enough.
+var attributionWindow *dateWindow
+
+// dateAttributionKey records the date an encounter without period.start was
+// first seen on.
+func dateAttributionKey(fullUrl string) string {
+	return "date_attribution:" + fullUrl
+}
+
+// outsideAttributedDate reports whether, with DATE_ATTRIBUTION=start, the
+// encounter belongs to another date and must be skipped here. An encounter
+// that spans midnight is returned by the search of every day it touches; it
+// is attributed to the day of its period.start (in PERIOD_TIMEZONE when set)
+// and only sent from that day's window. Encounters without period.start are
+// sent from the first window that sees them, recorded under
+// date_attribution:<fullUrl> for DEDUP_TTL.
+func outsideAttributedDate(ctx context.Context, enc Encounter, fullUrl string) bool {
+	window := attributionWindow
+	if cfg.DateAttribution != "start" || window == nil {
+		return false
+	}
+
+	if start := enc.Period.Start.Time; !start.IsZero() {
+		if periodLocation != nil {
+			start = start.In(periodLocation)
+		}
+		return !slices.Contains(window.Days(), start.Format("2006-01-02"))
+	}
+
+	label := window.Label()
+	if suppressWrite("setnx", dateAttributionKey(fullUrl), "value", label) {
+		return false
+	}
+	claimed, err := redisRetry(ctx, "setnx date_attribution", func() (bool, error) {
+		return redisClient.SetNX(ctx, dateAttributionKey(fullUrl), label, cfg.DedupTTL).Result()
+	})
+	if err != nil {
+		slog.Error("Error recording date attribution, processing anyway", "fullUrl", fullUrl, "error", err)
+		return false
+	}
+	if claimed {
+		return false
+	}
+	// A retry of the same window finds its own claim.
+	attributed, err := redisRetry(ctx, "get date_attribution", func() (string, error) {
+		return redisClient.Get(ctx, dateAttributionKey(fullUrl)).Result()
+	})
+	if err != nil && err != redis.Nil {
+		slog.Error("Error reading date attribution, processing anyway", "fullUrl", fullUrl, "error", err)
+		return false
+	}
+	return attributed != "" && attributed != label
+}
+
+// setAttributionWindow makes window the one DATE_ATTRIBUTION compares
+// against until the returned function is called.
+func setAttributionWindow(window dateWindow) (clear func()) {
+	attributionWindow = &window
+	return func() { attributionWindow = nil }
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// dateCompleteMessage is the control message DATE_COMPLETE_MARKER sends once
+// every encounter of a date window has been handled, so consumers can start
+// aggregating it. Type tells it apart from data messages.
+type dateCompleteMessage struct {
+	Type           string   `json:"type"`
+	Date           string   `json:"date"`
+	Days           []string `json:"days"`
+	EncountersSent int      `json:"encountersSent"`
+	Entries        int      `json:"entries"`
+	Truncated      bool     `json:"truncated,omitempty"`
+}
+
+// dateCompleteGroup is the MessageGroupId of the markers, which keeps them
+// in order among themselves.
+const dateCompleteGroup = "date-complete"
+
+// sendDateComplete sends the marker for window. It runs after the window's
+// search returned, when every encounter send has already completed, so the
+// marker reaches the queue after the window's data. A failed marker is
+// recorded in date_complete_failed rather than failing a date whose data
+// was delivered.
+func sendDateComplete(ctx context.Context, window dateWindow, result searchResult, sent int) {
+	if !cfg.DateCompleteMarker || !sqsSinkEnabled {
+		return
+	}
+	marker := dateCompleteMessage{
+		Type:           "date-complete",
+		Date:           window.Label(),
+		Days:           window.Days(),
+		EncountersSent: sent,
+		Entries:        result.Entries,
+		Truncated:      result.Truncated,
+	}
+	if err := enqueueSQS(ctx, marker, "", dateCompleteGroup); err != nil {
+		slog.Error("Error sending date-complete marker", "date", marker.Date, "error", err)
+		if err := state.AddToSet(ctx, "date_complete_failed", window.Days()...); err != nil {
+			slog.Error("Error adding to date_complete_failed", "error", err)
+		}
+		return
+	}
+	slog.Info("Date-complete marker sent", "date", marker.Date, "encountersSent", sent, "entries", result.Entries)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// dateFailureCooldown is the pause after a failed attempt at a date, separate
+// from the per-request backoff: DATE_FAILURE_COOLDOWN, or
+// DATE_FAILURE_STREAK_COOLDOWN once consecutive dates have failed
+// DATE_FAILURE_STREAK times in a row, so a degraded server gets room to
+// recover during a backfill instead of being hit by the retry or the next
+// date at once.
+func dateFailureCooldown(consecutive int) time.Duration {
+	if cfg.DateFailureStreakCooldown > 0 && consecutive >= cfg.DateFailureStreak {
+		return cfg.DateFailureStreakCooldown
+	}
+	return cfg.DateFailureCooldown
+}
+
+// coolDownAfterDateFailure waits dateFailureCooldown before retrying date or,
+// once it was given up, before the next date, cut short when the run is
+// cancelled. consecutive counts the dates given up in a row so far.
+func coolDownAfterDateFailure(ctx context.Context, date string, consecutive int, retry bool) {
+	wait := dateFailureCooldown(consecutive)
+	if wait <= 0 {
+		return
+	}
+	next := "the next date"
+	if retry {
+		next = "retrying it"
+	}
+	slog.Warn("Pausing after date failure before "+next, "date", date, "consecutiveFailures", consecutive, "cooldown", wait)
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+}
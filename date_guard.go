@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var errDateParameterIgnored = errors.New("server appears to ignore the date search parameter")
+
+// checkDateWindow inspects the first page of a date search. A server that
+// ignores the date parameter returns the same encounters for every day, so
+// when more than DATE_GUARD_MAX_OUTSIDE of the dated entries have a period
+// that does not touch the window (with a day of slack for time zones) it
+// warns or, with DATE_GUARD=abort, fails before any entry is dispatched.
+func checkDateWindow(window dateWindow, entries []BundleEntry) error {
+	if cfg.DateGuard == "off" {
+		return nil
+	}
+
+	from := window.Start.Add(-24 * time.Hour)
+	to := window.End.Add(48 * time.Hour)
+	dated, outside := 0, 0
+	for _, entry := range entries {
+		period := entry.Resource.Period
+		if period.Start.IsZero() {
+			continue
+		}
+		dated++
+		if !period.Start.Before(to) || (!period.End.IsZero() && period.End.Before(from)) {
+			outside++
+		}
+	}
+	if dated == 0 || float64(outside)/float64(dated) <= cfg.DateGuardMaxOutside {
+		return nil
+	}
+
+	slog.Warn("Encounters returned outside the requested date, the server may be ignoring the date parameter",
+		"date", window.Label(), "outside", outside, "sampled", dated)
+	if cfg.DateGuard == "abort" {
+		return fmt.Errorf("%w: %d of %d encounters fall outside %s", errDateParameterIgnored, outside, dated, window.Label())
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFileState points state at a file store in a temporary directory for
+// the duration of the test.
+func useFileState(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	saved := state
+	t.Cleanup(func() { state = saved })
+	state = &fileStateStore{dir: dir, sets: map[string]map[string]bool{}}
+	return dir
+}
+
+func TestRunDateRangeSkipsPersistentlyFailingDate(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.StateStore = "file"
+		c.BatchDays = 1
+		c.MaxDateAttempts = 3
+		c.CursorCommitEvery = 1
+		c.PrefetchNextDate = false
+		c.FailFast = false
+	})
+	dir := useFileState(t)
+
+	var attempts []string
+	process := func(ctx context.Context, window dateWindow, prefetch *pagePrefetch) error {
+		attempts = append(attempts, window.Label())
+		if window.Label() == "2024-01-02" {
+			return errors.New("server error")
+		}
+		return nil
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runDateRange(context.Background(), start, end, process)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDateRange did not return, the failing date wedged the loop")
+	}
+
+	want := []string{"2024-01-01", "2024-01-02", "2024-01-02", "2024-01-02", "2024-01-03", "2024-01-04"}
+	if !slices.Equal(attempts, want) {
+		t.Fatalf("dates processed = %v, want %v", attempts, want)
+	}
+
+	unprocessed, err := os.ReadFile(filepath.Join(dir, "unprocessed_dates.txt"))
+	if err != nil {
+		t.Fatalf("reading unprocessed_dates: %v", err)
+	}
+	if got := strings.Fields(string(unprocessed)); !slices.Equal(got, []string{"2024-01-02"}) {
+		t.Fatalf("unprocessed_dates = %v, want [2024-01-02]", got)
+	}
+
+	cursor, err := state.GetCursor(context.Background(), "last_processed_date")
+	if err != nil {
+		t.Fatalf("reading cursor: %v", err)
+	}
+	if cursor != "2024-01-04" {
+		t.Fatalf("last_processed_date = %q, want 2024-01-04", cursor)
+	}
+}
+
+// resetRunAbort clears the run's abort state after the test.
+func resetRunAbort(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		runAbort.mu.Lock()
+		runAbort.err, runAbort.cancel = nil, nil
+		runAbort.mu.Unlock()
+	})
+}
+
+func TestRunDateRangeAbortsWhenDateParameterIgnored(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.StateStore = "file"
+		c.BatchDays = 1
+		c.PrefetchNextDate = false
+		c.FailFast = false
+	})
+	useFileState(t)
+	resetRunAbort(t)
+
+	var attempts []string
+	process := func(ctx context.Context, window dateWindow, prefetch *pagePrefetch) error {
+		attempts = append(attempts, window.Label())
+		return errDateParameterIgnored
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	runDateRange(context.Background(), start, start.AddDate(0, 0, 3), process)
+
+	if !slices.Equal(attempts, []string{"2024-01-01"}) {
+		t.Fatalf("dates processed = %v, want only the first", attempts)
+	}
+	if !errors.Is(runAborted(), errDateParameterIgnored) {
+		t.Fatalf("runAborted() = %v, want errDateParameterIgnored", runAborted())
+	}
+	if code := runExitCode(); code != exitAborted {
+		t.Fatalf("runExitCode() = %d, want %d", code, exitAborted)
+	}
+}
+
+func TestRunDateRangeCoolsDownBetweenRetries(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	setConfig(t, func(c *Config) {
+		c.StateStore = "file"
+		c.BatchDays = 1
+		c.MaxDateAttempts = 3
+		c.PrefetchNextDate = false
+		c.FailFast = false
+		c.DateFailureCooldown = cooldown
+	})
+	useFileState(t)
+
+	var attemptTimes []time.Time
+	process := func(ctx context.Context, window dateWindow, prefetch *pagePrefetch) error {
+		attemptTimes = append(attemptTimes, time.Now())
+		if len(attemptTimes) < 3 {
+			return errors.New("server error")
+		}
+		return nil
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	runDateRange(context.Background(), start, start, process)
+
+	if len(attemptTimes) != 3 {
+		t.Fatalf("attempts = %d, want 3", len(attemptTimes))
+	}
+	for i := 1; i < len(attemptTimes); i++ {
+		if gap := attemptTimes[i].Sub(attemptTimes[i-1]); gap < cooldown {
+			t.Errorf("attempt %d started %s after the previous one, want at least %s", i+1, gap, cooldown)
+		}
+	}
+}
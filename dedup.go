@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// runID scopes DEDUP_REFERENCES to one run: RUN_ID when the scheduler sets
+// it (so a restarted run keeps deduplicating against what it already sent),
+// otherwise an ID unique to this process.
+var runID string
+
+func initRunID() {
+	runID = cfg.RunID
+	if runID == "" {
+		runID = fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405Z"), os.Getpid())
+	}
+}
+
+// sentResources remembers the Patient and Practitioner IDs already sent in
+// this process, so each is sent once: always in split format, and in the
+// combined format with DEDUP_REFERENCES. Encounters that share a resource
+// wait for its first send, keeping it ahead of them in the queue.
+var sentResources sync.Map
+
+type resourceSend struct {
+	done chan struct{}
+	err  error
+}
+
+// resourceClaim is the right, and the duty, to send a resource's full data;
+// finish releases it with the send's result.
+type resourceClaim struct {
+	key          string
+	resourceType string
+	id           string
+	send         *resourceSend
+}
+
+// claimResource returns a claim when this message must carry the
+// resource's full data, or sent=true when another message already delivered
+// it. An in-flight send of the same resource is waited on: only once it
+// succeeded is the resource taken as sent, and if it failed the claim passes
+// to this message. With DEDUP_REFERENCES, Redis also covers sends from
+// earlier processes of the same run. A nil claim with sent=false means the
+// wait was cancelled; the caller sends the data without owning it.
+func claimResource(ctx context.Context, resourceType string, id string) (claim *resourceClaim, sent bool) {
+	key := resourceType + "/" + id
+	for {
+		send := &resourceSend{done: make(chan struct{})}
+		existing, loaded := sentResources.LoadOrStore(key, send)
+		if !loaded {
+			if cfg.DedupReferences && resourceAlreadySent(ctx, resourceType, id) {
+				close(send.done)
+				return nil, true
+			}
+			return &resourceClaim{key: key, resourceType: resourceType, id: id, send: send}, false
+		}
+
+		previous := existing.(*resourceSend)
+		select {
+		case <-previous.done:
+		case <-ctx.Done():
+			return nil, false
+		}
+		if previous.err == nil {
+			return nil, true
+		}
+		// The failed owner released the key before signalling; try to take
+		// it over.
+	}
+}
+
+// finish records the outcome of the send that carried the claimed
+// resource. Only a successful send marks it as sent; after a failure the
+// next message that needs it sends it again.
+func (c *resourceClaim) finish(ctx context.Context, err error) {
+	if c == nil {
+		return
+	}
+	if err != nil {
+		sentResources.Delete(c.key)
+		c.send.err = err
+	} else if cfg.DedupReferences {
+		markResourceSent(ctx, c.resourceType, c.id)
+	}
+	close(c.send.done)
+}
+
+// resourceAlreadySent reports whether the run's sent_<type> set in Redis
+// holds the resource. Redis errors count as not sent, so data is re-sent
+// rather than lost.
+func resourceAlreadySent(ctx context.Context, resourceType string, id string) bool {
+	key := sentResourcesKey(resourceType)
+	sent, err := redisRetry(ctx, "sismember "+key, func() (bool, error) {
+		return redisClient.SIsMember(ctx, key, id).Result()
+	})
+	if err != nil {
+		slog.Error("Error reading sent resources, sending full data", "key", key, "error", err)
+		return false
+	}
+	return sent
+}
+
+// markResourceSent adds a delivered resource to the run's sent_<type> set.
+// SADD and EXPIRE run in one transaction so the set never outlives
+// DEDUP_TTL.
+func markResourceSent(ctx context.Context, resourceType string, id string) {
+	key := sentResourcesKey(resourceType)
+	if suppressWrite("sadd", key, "member", id) {
+		return
+	}
+	_, err := redisRetry(ctx, "sadd "+key, func() ([]redis.Cmder, error) {
+		return redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SAdd(ctx, key, id)
+			if cfg.DedupTTL > 0 {
+				pipe.Expire(ctx, key, cfg.DedupTTL)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		slog.Error("Error recording sent resource", "key", key, "error", err)
+	}
+}
+
+// sentResourcesKey is sent_patients:<run> or sent_practitioners:<run>.
+func sentResourcesKey(resourceType string) string {
+	if resourceType == "Patient" {
+		return "sent_patients:" + runID
+	}
+	return "sent_practitioners:" + runID
+}
+
+// dedupCombinedMessage replaces a Patient or Practitioner already sent with
+// just its ID, flagging it as omitted, and returns the function the caller
+// must call with the message's send result. The practitioner is always
+// claimed before the patient and nothing is waited on once the patient is
+// claimed, so two messages cannot wait on each other.
+func dedupCombinedMessage(ctx context.Context, message *FHIRMessage) (finish func(err error)) {
+	var claims []*resourceClaim
+	// Unresolved under MISSING_REFERENCE=skip, so there is nothing to send.
+	if !message.PractitionerMissing {
+		claim, sent := claimResource(ctx, "Practitioner", message.Practitioner.FhirId)
+		if sent {
+			message.Practitioner = PractitionerDB{FhirId: message.Practitioner.FhirId}
+			message.PractitionerOmitted = true
+		}
+		claims = append(claims, claim)
+	}
+	if !message.PatientMissing {
+		claim, sent := claimResource(ctx, "Patient", message.Patient.FhirId)
+		if sent {
+			message.Patient = PatientDB{FhirId: message.Patient.FhirId}
+			message.PatientOmitted = true
+		}
+		claims = append(claims, claim)
+	}
+
+	return func(err error) {
+		for _, claim := range claims {
+			claim.finish(ctx, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClaimResourceWaitsForInFlightSend(t *testing.T) {
+	setConfig(t, func(c *Config) { c.DedupReferences = false })
+	const id = "claim-test"
+	t.Cleanup(func() { sentResources.Delete("Patient/" + id) })
+	ctx := context.Background()
+
+	first, sent := claimResource(ctx, "Patient", id)
+	if first == nil || sent {
+		t.Fatalf("first claim = %v, sent %t; want a claim", first, sent)
+	}
+
+	type result struct {
+		claim *resourceClaim
+		sent  bool
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		claim, sent := claimResource(ctx, "Patient", id)
+		waiter <- result{claim, sent}
+	}()
+	select {
+	case r := <-waiter:
+		t.Fatalf("second claim returned %+v while the first send was in flight", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first send fails, so the waiting message must carry the data.
+	first.finish(ctx, errors.New("send failed"))
+	var second result
+	select {
+	case second = <-waiter:
+	case <-time.After(time.Second):
+		t.Fatal("second claim still waiting after the first send finished")
+	}
+	if second.claim == nil || second.sent {
+		t.Fatalf("after a failed send: claim = %v, sent %t; want the claim", second.claim, second.sent)
+	}
+
+	second.claim.finish(ctx, nil)
+	if claim, sent := claimResource(ctx, "Patient", id); claim != nil || !sent {
+		t.Fatalf("after a successful send: claim = %v, sent %t; want sent", claim, sent)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// dateWalk is the order runDateRange visits dates in: oldest first up to
+// limit, or, with DIRECTION=desc, newest first down to limit. Walking
+// backwards, the cursor tracks the oldest completed date instead, under its
+// own key so switching directions never misreads it.
+type dateWalk struct {
+	desc  bool
+	limit time.Time
+}
+
+func newDateWalk(limit time.Time) dateWalk {
+	return dateWalk{desc: cfg.Direction == "desc", limit: limit}
+}
+
+// cursorName is the state store key of the walk's cursor.
+func (w dateWalk) cursorName() string {
+	if w.desc {
+		return "oldest_processed_date"
+	}
+	return "last_processed_date"
+}
+
+// limitName names the setting the walk stops at, for logs.
+func (w dateWalk) limitName() string {
+	if w.desc {
+		return "START_DATE"
+	}
+	return "END_DATE"
+}
+
+func (w dateWalk) done(current time.Time) bool {
+	if w.desc {
+		return current.Before(w.limit)
+	}
+	return current.After(w.limit)
+}
+
+// window is the BATCH_DAYS window starting at current in the walk's
+// direction, clipped to the limit.
+func (w dateWalk) window(current time.Time) dateWindow {
+	if !w.desc {
+		return nextDateWindow(current, w.limit)
+	}
+	window := dateWindow{Start: current.Add(-time.Duration(cfg.BatchDays-1) * 24 * time.Hour), End: current}
+	if window.Start.Before(w.limit) {
+		window.Start = w.limit
+	}
+	return window
+}
+
+// next is the first date after window in the walk's direction.
+func (w dateWalk) next(window dateWindow) time.Time {
+	if w.desc {
+		return window.Start.Add(-24 * time.Hour)
+	}
+	return window.End.Add(24 * time.Hour)
+}
+
+// days lists the window's days in the order the cursor advances through
+// them, so the last one is where a restart resumes.
+func (w dateWalk) days(window dateWindow) []string {
+	days := window.Days()
+	if w.desc {
+		slices.Reverse(days)
+	}
+	return days
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// errResponseParse marks a FHIR response that arrived but could not be
+// decoded, so error events can tell it apart from a failed fetch.
+var errResponseParse = errors.New("invalid JSON response")
+
+// errorEvent is one significant failure: a fetch that failed after its
+// retries, a response that could not be parsed, or a message that could not
+// be sent. Resource is what was being fetched or sent and FullUrl the
+// encounter it belonged to, when known.
+type errorEvent struct {
+	Phase    string    `json:"phase"`
+	Resource string    `json:"resource"`
+	FullUrl  string    `json:"fullUrl"`
+	Error    string    `json:"error"`
+	At       time.Time `json:"at"`
+}
+
+// errorEventLog is the feed selected by ERROR_EVENTS, written alongside the
+// logs for alerting: a Redis stream (ERROR_STREAM) or an NDJSON file
+// (ERROR_EVENTS_FILE).
+type errorEventLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var errorEvents *errorEventLog
+
+func openErrorEvents() (*errorEventLog, error) {
+	switch cfg.ErrorEvents {
+	case "":
+		return nil, nil
+	case "file":
+		if err := os.MkdirAll(filepath.Dir(cfg.ErrorEventsFile), 0o755); err != nil {
+			return nil, fmt.Errorf("error creating error events dir: %w", err)
+		}
+		file, err := os.OpenFile(cfg.ErrorEventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening error events file: %w", err)
+		}
+		return &errorEventLog{file: file}, nil
+	default:
+		return &errorEventLog{}, nil
+	}
+}
+
+// failurePhase classifies err for an error event, or returns "" when it is
+// not a failure worth an event: a cancelled run, or a resource that arrived
+// but was rejected, which the tracking sets already record.
+func failurePhase(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ""
+	case errors.Is(err, errReferenceMismatch), errors.Is(err, errInvalidReference):
+		return ""
+	case errors.Is(err, errResponseParse):
+		return "parse"
+	default:
+		return "fetch"
+	}
+}
+
+// emitErrorEvent records a failure in the ERROR_EVENTS feed. Writing the
+// event is best effort: a failure here is logged and never changes how the
+// original failure is handled.
+func emitErrorEvent(ctx context.Context, phase string, resource string, fullUrl string, err error) {
+	if errorEvents == nil || phase == "" {
+		return
+	}
+	errorEvents.Record(ctx, errorEvent{
+		Phase:    phase,
+		Resource: resource,
+		FullUrl:  fullUrl,
+		Error:    err.Error(),
+		At:       time.Now().UTC(),
+	})
+}
+
+func (l *errorEventLog) Record(ctx context.Context, event errorEvent) {
+	if l.file == nil {
+		if suppressWrite("xadd", cfg.ErrorStream, "phase", event.Phase, "resource", event.Resource, "error", event.Error) {
+			return
+		}
+		// The run's context may be the reason for the failure; the event
+		// is still worth writing.
+		ctx := context.WithoutCancel(ctx)
+		_, err := redisRetry(ctx, "xadd "+cfg.ErrorStream, func() (string, error) {
+			return redisClient.XAdd(ctx, &redis.XAddArgs{
+				Stream: cfg.ErrorStream,
+				Values: map[string]interface{}{
+					"phase":    event.Phase,
+					"resource": event.Resource,
+					"fullUrl":  event.FullUrl,
+					"error":    event.Error,
+					"at":       event.At.Format(time.RFC3339Nano),
+				},
+			}).Result()
+		})
+		if err != nil {
+			slog.Error("Error writing error event", "phase", event.Phase, "resource", event.Resource, "error", err)
+		}
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding error event", "phase", event.Phase, "resource", event.Resource, "error", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Error writing error event", "phase", event.Phase, "resource", event.Resource, "error", err)
+	}
+}
+
+func (l *errorEventLog) Close() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		slog.Error("Error syncing error events file", "error", err)
+	}
+	l.file.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// Process exit codes. 2 is left to the flag package for usage errors.
+const (
+	exitAborted        = 1
+	exitPartialFailure = 3
+)
+
+// processExitCode is set by finishRun and applied by main once every
+// deferred cleanup has run.
+var processExitCode int
+
+// runExitCode maps the run outcome to an exit code so a scheduler can tell a
+// half-failed run from a clean one: FAIL_FAST aborts exit 1; more failed
+// dates or patients than EXIT_MAX_FAILED, or an invalid-encounter rate above
+// EXIT_MAX_INVALID_RATE, exit 3.
+func runExitCode() int {
+	if runAborted() != nil {
+		return exitAborted
+	}
+
+	stats.mu.Lock()
+	failed := stats.DatesFailed + stats.PatientsFailed
+	seen := stats.EncountersSeen
+	invalid := stats.Flagged["invalid_encounters"]
+	stats.mu.Unlock()
+
+	if failed > cfg.ExitMaxFailed {
+		return exitPartialFailure
+	}
+	if seen > 0 && float64(invalid)/float64(seen) > cfg.ExitMaxInvalidRate {
+		return exitPartialFailure
+	}
+	return 0
+}
+
+// finishRun writes the run summary and records the exit code for main.
+func finishRun() {
+	processExitCode = runExitCode()
+	stats.update(func(s *runStats) { s.ExitCode = processExitCode })
+	writeRunStats()
+
+	stats.mu.Lock()
+	slog.Info("Finish!",
+		"exitCode", processExitCode,
+		"datesProcessed", stats.DatesProcessed,
+		"datesFailed", stats.DatesFailed,
+		"patientsProcessed", stats.PatientsProcessed,
+		"patientsFailed", stats.PatientsFailed,
+		"encountersSeen", stats.EncountersSeen,
+		"encountersSent", stats.EncountersSent,
+		"invalidEncounters", stats.Flagged["invalid_encounters"],
+	)
+	stats.mu.Unlock()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// runAbort holds the first unrecoverable error seen under FAIL_FAST and
+// cancels the run context so in-flight encounters stop.
+var runAbort struct {
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+// withRunCancel derives the context that FAIL_FAST cancels. Cleanup that must
+// still reach Redis (cursor flush, lock release) uses the parent instead. A
+// run aborted before this point, e.g. by losing the lock during warm-up,
+// gets an already cancelled context.
+func withRunCancel(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	runAbort.mu.Lock()
+	runAbort.cancel = cancel
+	if runAbort.err != nil {
+		cancel()
+	}
+	runAbort.mu.Unlock()
+	return ctx
+}
+
+// abortRun records err as the reason the run stops and cancels the run
+// context. Only the first call takes effect. FAIL_FAST errors come through
+// abortOnFatal; DATE_GUARD=abort and a lost RUN_LOCK call it directly.
+func abortRun(err error) {
+	runAbort.mu.Lock()
+	defer runAbort.mu.Unlock()
+	if runAbort.err != nil {
+		return
+	}
+	slog.Error("Aborting run", "failFast", cfg.FailFast, "error", err)
+	runAbort.err = err
+	if runAbort.cancel != nil {
+		runAbort.cancel()
+	}
+}
+
+// abortOnFatal aborts the run when FAIL_FAST is on and err is fatal, and
+// reports whether the run is now aborted.
+func abortOnFatal(err error) bool {
+	if cfg.FailFast && isFatalError(err) {
+		abortRun(err)
+	}
+	return runAborted() != nil
+}
+
+func runAborted() error {
+	runAbort.mu.Lock()
+	defer runAbort.mu.Unlock()
+	return runAbort.err
+}
+
+// checkInvalidRate aborts the run, FAIL_FAST or not, once at least
+// ABORT_INVALID_MIN_SEEN encounters were seen and the fraction flagged in
+// invalid_encounters exceeds ABORT_INVALID_RATE: a wrong server or error
+// pages served as FHIR would otherwise run to completion producing garbage.
+func checkInvalidRate() {
+	if cfg.AbortInvalidRate <= 0 {
+		return
+	}
+
+	stats.mu.Lock()
+	seen := stats.EncountersSeen
+	invalid := stats.Flagged["invalid_encounters"]
+	stats.mu.Unlock()
+
+	if seen < cfg.AbortInvalidMinSeen {
+		return
+	}
+	if rate := float64(invalid) / float64(seen); rate > cfg.AbortInvalidRate {
+		abortRun(fmt.Errorf("%d de %d encontros inválidos (%.0f%%), acima de ABORT_INVALID_RATE", invalid, seen, rate*100))
+	}
+}
+
+// isFatalError separates errors that retrying cannot fix (rejected
+// credentials, a server ignoring the date parameter) from transient ones
+// (timeouts, 429 and 5xx responses), which the fetch and date retries absorb.
+func isFatalError(err error) bool {
+	if errors.Is(err, errDateParameterIgnored) {
+		return true
+	}
+	var statusErr *statusError
+	return errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden)
+}
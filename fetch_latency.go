@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchLatencyBuckets are the upper bounds, in seconds, of the FHIR fetch
+// latency histograms; the last bucket is +Inf.
+var fetchLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+// fhirFetchLatency is published on /debug/vars as fhir_fetch_latency_seconds:
+// one histogram per resource type and status code, e.g.
+// fhir_fetch_latency_seconds["Patient"]["200"]. Latency runs from sending
+// the request until its body is closed, so it covers reading the body, as
+// HTTP_TIMEOUT does.
+var fhirFetchLatency = expvar.NewMap("fhir_fetch_latency_seconds")
+
+var fetchLatencyMu sync.Mutex
+
+// latencyHistogram is a cumulative histogram over fetchLatencyBuckets in
+// the Prometheus layout: each bucket counts observations up to its bound.
+type latencyHistogram struct {
+	mu      sync.Mutex
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+func (h *latencyHistogram) Observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range fetchLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// String implements expvar.Var.
+func (h *latencyHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var b strings.Builder
+	b.WriteString(`{"buckets": {`)
+	for i, bound := range fetchLatencyBuckets {
+		fmt.Fprintf(&b, "%q: %d, ", strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+	}
+	fmt.Fprintf(&b, `"+Inf": %d}, "count": %d, "sum": %s}`, h.count, h.count, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	return b.String()
+}
+
+// observeFetchLatency records one FHIR request. status is the HTTP status
+// code, or "error" when no response arrived.
+func observeFetchLatency(resourceType string, status string, elapsed time.Duration) {
+	fetchLatencyMu.Lock()
+	byStatus, ok := fhirFetchLatency.Get(resourceType).(*expvar.Map)
+	if !ok {
+		byStatus = new(expvar.Map)
+		fhirFetchLatency.Set(resourceType, byStatus)
+	}
+	histogram, ok := byStatus.Get(status).(*latencyHistogram)
+	if !ok {
+		histogram = &latencyHistogram{buckets: make([]int64, len(fetchLatencyBuckets))}
+		byStatus.Set(status, histogram)
+	}
+	fetchLatencyMu.Unlock()
+	histogram.Observe(elapsed.Seconds())
+}
+
+// fetchResourceType labels a FHIR request URL for fhirFetchLatency: the
+// resource type for a read ("Patient"), "<type> search" for a search
+// ("Encounter search"), "page" for a paging link on the base itself and
+// "metadata" for the CapabilityStatement.
+func fetchResourceType(requestURL *url.URL) string {
+	path := requestURL.Path
+	if server, _ := serverFor(requestURL.String()); server != nil {
+		if base, err := url.Parse(server.Base); err == nil {
+			path = strings.TrimPrefix(path, base.Path)
+		}
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case segments[0] == "":
+		return "page"
+	case segments[0] == "metadata":
+		return "metadata"
+	case len(segments) == 1:
+		return segments[0] + " search"
+	default:
+		return segments[0]
+	}
+}
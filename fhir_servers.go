@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fhirServer is one configured FHIR base URL: FHIR_BASE_URL first, then
+// FHIR_FAILOVER_URLS in order. A server whose retries are exhausted by a
+// persistent error is marked down for FHIR_FAILOVER_COOLDOWN, during which
+// new searches are built against the next server that is up.
+type fhirServer struct {
+	Base string
+	// Source is set once at startup by loadServerSources.
+	Source MessageSource
+
+	mu                  sync.Mutex
+	fetches             int
+	failures            int
+	consecutiveFailures int
+	downUntil           time.Time
+	lastError           string
+}
+
+var fhirServers []*fhirServer
+
+func initFHIRServers() {
+	fhirServers = []*fhirServer{{Base: cfg.FHIRBaseURL}}
+	for _, base := range splitList(cfg.FHIRFailoverURLs) {
+		fhirServers = append(fhirServers, &fhirServer{Base: strings.TrimRight(base, "/")})
+	}
+	expvar.Publish("fhir_servers", expvar.Func(fhirServerHealth))
+}
+
+// activeFHIRBase is the base new requests are built against: the first
+// server that is not down, or FHIR_BASE_URL when every server is.
+func activeFHIRBase() string {
+	for _, server := range fhirServers {
+		if server.up() {
+			return server.Base
+		}
+	}
+	return cfg.FHIRBaseURL
+}
+
+// serverFor returns the configured server url belongs to and the rest of
+// the URL after its base, or nil when url is under none of them.
+func serverFor(url string) (*fhirServer, string) {
+	var match *fhirServer
+	for _, server := range fhirServers {
+		if strings.HasPrefix(url, server.Base+"/") || strings.HasPrefix(url, server.Base+"?") {
+			if match == nil || len(server.Base) > len(match.Base) {
+				match = server
+			}
+		}
+	}
+	if match == nil {
+		return nil, url
+	}
+	return match, strings.TrimPrefix(url, match.Base)
+}
+
+func (s *fhirServer) up() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().After(s.downUntil)
+}
+
+func (s *fhirServer) recordSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	s.consecutiveFailures = 0
+	s.downUntil = time.Time{}
+}
+
+func (s *fhirServer) recordFailure(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	s.failures++
+	s.consecutiveFailures++
+	s.downUntil = time.Now().Add(cfg.FHIRFailoverCooldown)
+	s.lastError = err.Error()
+}
+
+// fhirServerHealth is published on /debug/vars as fhir_servers.
+func fhirServerHealth() any {
+	health := make([]map[string]any, 0, len(fhirServers))
+	for _, server := range fhirServers {
+		server.mu.Lock()
+		health = append(health, map[string]any{
+			"base":                server.Base,
+			"up":                  time.Now().After(server.downUntil),
+			"fetches":             server.fetches,
+			"failures":            server.failures,
+			"consecutiveFailures": server.consecutiveFailures,
+			"lastError":           server.lastError,
+		})
+		server.mu.Unlock()
+	}
+	return health
+}
+
+// isServerFailure reports whether err means the server itself is failing,
+// as opposed to the request being refused or the resource missing, which a
+// replica would answer the same way.
+func isServerFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// retryFetchFailover runs retryFetch against the server url belongs to and,
+// when its retries end in a server failure, against the remaining servers
+// that are up, rewriting the base of url. It returns the base that answered
+// so relative references can be resolved against the same server. URLs
+// under no configured base are fetched as they are.
+func retryFetchFailover[T any](ctx context.Context, url string, maxRetries int, fetch func(ctx context.Context, url string) (T, error)) (T, string, error) {
+	server, rest := serverFor(url)
+	if server == nil {
+		data, err := retryFetch(ctx, url, maxRetries, func(ctx context.Context) (T, error) {
+			return fetch(ctx, url)
+		})
+		return data, "", err
+	}
+
+	var zero T
+	var lastErr error
+	for _, candidate := range failoverOrder(server) {
+		candidateURL := candidate.Base + rest
+		if candidate != server {
+			slog.Warn("Falha persistente no servidor FHIR, tentando o próximo", "from", server.Base, "to", candidate.Base, "error", lastErr)
+		}
+		data, err := retryFetch(ctx, candidateURL, maxRetries, func(ctx context.Context) (T, error) {
+			return fetch(ctx, candidateURL)
+		})
+		if err == nil {
+			candidate.recordSuccess()
+			return data, candidate.Base, nil
+		}
+		if !isServerFailure(err) {
+			return zero, candidate.Base, err
+		}
+		candidate.recordFailure(err)
+		lastErr = err
+	}
+	return zero, "", lastErr
+}
+
+// failoverOrder is first, which is always tried since the URL was built or
+// returned for it, followed by the other servers that are up.
+func failoverOrder(first *fhirServer) []*fhirServer {
+	order := []*fhirServer{first}
+	for _, server := range fhirServers {
+		if server != first && server.up() {
+			order = append(order, server)
+		}
+	}
+	return order
+}
+
+// splitReference returns the base a reference is resolved against and its
+// Type/id part. A relative reference resolves against base, the server that
+// returned the encounter; an absolute one, e.g.
+// https://other/fhir/Practitioner/1, against its own server, which may be
+// none of the configured ones.
+func splitReference(base string, ref string) (string, string) {
+	if !strings.Contains(ref, "://") {
+		return base, ref
+	}
+	idStart := strings.LastIndex(ref, "/")
+	typeStart := strings.LastIndex(ref[:idStart], "/")
+	if typeStart <= strings.Index(ref, "://")+2 {
+		return base, ref
+	}
+	return ref[:typeStart], ref[typeStart+1:]
+}
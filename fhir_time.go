@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// fhirDateTimeLayouts are tried in order. Besides RFC 3339 they cover the
+// partial dates FHIR dateTime allows and the zone-less or colon-less
+// timestamps some servers send; a value without a zone is taken as UTC.
+var fhirDateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// fhirDateTime is a dateTime read from a FHIR resource. A value that fits
+// none of fhirDateTimeLayouts, or is not a JSON string at all, does not
+// fail the decoding of the whole Bundle: Time stays zero and Raw keeps the
+// value so the encounter alone can be rejected.
+type fhirDateTime struct {
+	time.Time
+	Raw string
+}
+
+func (t *fhirDateTime) UnmarshalJSON(data []byte) error {
+	*t = fhirDateTime{}
+	if string(data) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		t.Raw = string(data)
+		return nil
+	}
+	if text == "" {
+		return nil
+	}
+	for _, layout := range fhirDateTimeLayouts {
+		if parsed, err := time.Parse(layout, text); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	t.Raw = text
+	return nil
+}
+
+// Invalid reports whether the value was present but could not be parsed.
+func (t fhirDateTime) Invalid() bool {
+	return t.Raw != ""
+}
+
+// invalidPeriodError describes the period fields of enc that could not be
+// parsed, with their raw values, or returns nil.
+func invalidPeriodError(enc Encounter) error {
+	switch {
+	case enc.Period.Start.Invalid() && enc.Period.End.Invalid():
+		return fmt.Errorf("invalid period.start %q and period.end %q", enc.Period.Start.Raw, enc.Period.End.Raw)
+	case enc.Period.Start.Invalid():
+		return fmt.Errorf("invalid period.start %q", enc.Period.Start.Raw)
+	case enc.Period.End.Invalid():
+		return fmt.Errorf("invalid period.end %q", enc.Period.End.Raw)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// administrativeGenders is the FHIR R4 AdministrativeGender value set.
+var administrativeGenders = map[string]bool{
+	"male":    true,
+	"female":  true,
+	"other":   true,
+	"unknown": true,
+}
+
+// normalizeGender lowercases Patient.gender and applies
+// GENDER_OUTSIDE_VALUE_SET to values outside the value set: unknown maps them
+// to "unknown", flag also records the patient in unknown_gender_patients, and
+// keep passes them through. An absent gender stays empty.
+func normalizeGender(ctx context.Context, gender string, patientRef string) string {
+	normalized := strings.ToLower(strings.TrimSpace(gender))
+	if normalized == "" || administrativeGenders[normalized] {
+		return normalized
+	}
+
+	slog.Warn("Patient gender outside the FHIR value set", "gender", gender, "reference", patientRef, "policy", cfg.GenderOutsideValueSet)
+	switch cfg.GenderOutsideValueSet {
+	case "keep":
+		return gender
+	case "flag":
+		flagEncounter(ctx, "unknown_gender_patients", patientRef)
+	}
+	return "unknown"
+}
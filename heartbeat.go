@@ -0,0 +1,176 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// processingDate is the date window being processed, for the heartbeat and
+	// /debug/vars.
+	processingDate = expvar.NewString("current_date")
+
+	heartbeatsTotal   = expvar.NewInt("heartbeats_total")
+	stalledHeartbeats = expvar.NewInt("stalled_heartbeats_total")
+	lastHeartbeatUnix = expvar.NewInt("last_heartbeat_unix")
+)
+
+func init() {
+	expvar.Publish("fhir_requests_in_flight", expvar.Func(func() any { return fhirRequests.Count() }))
+}
+
+// startHeartbeat logs a heartbeat every HEARTBEAT_INTERVAL with the current
+// date, throughput since the previous beat and requests in flight, and warns
+// when no encounter was seen or sent in the interval. The returned function
+// stops it.
+func startHeartbeat(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var lastSeen, lastSent int
+		lastBeat := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				var seen, sent int
+				stats.update(func(s *runStats) { seen, sent = s.EncountersSeen, s.EncountersSent })
+				elapsed := now.Sub(lastBeat).Seconds()
+
+				heartbeatsTotal.Add(1)
+				lastHeartbeatUnix.Set(now.Unix())
+				attrs := []any{
+					"date", processingDate.Value(),
+					"encountersSeen", seen - lastSeen,
+					"encountersSent", sent - lastSent,
+					"sentPerSecond", float64(sent-lastSent) / elapsed,
+					"requestsInFlight", fhirRequests.Count(),
+				}
+				if seen == lastSeen && sent == lastSent {
+					stalledHeartbeats.Add(1)
+					slog.Warn("Heartbeat: nenhum encontro processado desde o último heartbeat", attrs...)
+				} else {
+					slog.Info("Heartbeat", attrs...)
+				}
+				lastSeen, lastSent, lastBeat = seen, sent, now
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// inFlightRequests tracks the FHIR requests in flight, for the heartbeat
+// count and the URLs the stall watchdog logs.
+type inFlightRequests struct {
+	mu       sync.Mutex
+	next     int
+	requests map[int]inFlightRequest
+}
+
+type inFlightRequest struct {
+	URL     string
+	Started time.Time
+}
+
+var fhirRequests = &inFlightRequests{requests: map[int]inFlightRequest{}}
+
+func (r *inFlightRequests) add(url string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	r.requests[r.next] = inFlightRequest{URL: url, Started: time.Now()}
+	return r.next
+}
+
+func (r *inFlightRequests) remove(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.requests, id)
+}
+
+func (r *inFlightRequests) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+// List describes each request in flight as "<url> (<age>)", oldest first.
+func (r *inFlightRequests) List() []string {
+	r.mu.Lock()
+	requests := make([]inFlightRequest, 0, len(r.requests))
+	for _, request := range r.requests {
+		requests = append(requests, request)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Started.Before(requests[j].Started) })
+	list := make([]string, len(requests))
+	for i, request := range requests {
+		list[i] = fmt.Sprintf("%s (%s)", request.URL, time.Since(request.Started).Round(time.Second))
+	}
+	return list
+}
+
+// countingTransport registers every FHIR request in fhirRequests from the
+// moment it is sent until its body is closed, and then records its latency
+// in fhirFetchLatency.
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := fhirRequests.add(req.URL.String())
+	resourceType := fetchResourceType(req.URL)
+	started := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		fhirRequests.remove(id)
+		observeFetchLatency(resourceType, "error", time.Since(started))
+		return nil, err
+	}
+	resp.Body = &countedBody{
+		ReadCloser:   resp.Body,
+		id:           id,
+		resourceType: resourceType,
+		status:       strconv.Itoa(resp.StatusCode),
+		started:      started,
+	}
+	return resp, nil
+}
+
+type countedBody struct {
+	io.ReadCloser
+	id           int
+	resourceType string
+	status       string
+	started      time.Time
+	once         sync.Once
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(func() {
+		fhirRequests.remove(b.id)
+		observeFetchLatency(b.resourceType, b.status, time.Since(b.started))
+	})
+	return b.ReadCloser.Close()
+}
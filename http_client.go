@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// fhirClient is shared by every FHIR request so connections are reused.
+var fhirClient = &http.Client{Timeout: 20 * time.Second}
+
+// initHTTPClient builds the FHIR client's transport. Requests go through
+// FHIR_PROXY_URL when set, otherwise through HTTP_PROXY/HTTPS_PROXY; NO_PROXY
+// applies in both cases. HTTP_DIAL_TIMEOUT and HTTP_TLS_TIMEOUT bound
+// connection setup separately from HTTP_TIMEOUT, which covers the whole
+// request including reading the body.
+func initHTTPClient() {
+	proxyConfig := httpproxy.FromEnvironment()
+	if cfg.FHIRProxyURL != "" {
+		proxyConfig.HTTPProxy = cfg.FHIRProxyURL
+		proxyConfig.HTTPSProxy = cfg.FHIRProxyURL
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	dialer := &net.Dialer{Timeout: cfg.HTTPDialTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = cfg.HTTPTLSTimeout
+	fhirClient = &http.Client{Timeout: cfg.HTTPTimeout, Transport: countingTransport{base: transport}}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// journalEntry records one message accepted by SQS. DedupID is the SHA-256
+// of the body, the same value SQS content-based deduplication uses, so the
+// journal can be reconciled against the downstream consumer.
+type journalEntry struct {
+	FullUrl   string    `json:"fullUrl"`
+	DedupID   string    `json:"dedupId"`
+	MessageID string    `json:"messageId"`
+	ClientID  string    `json:"clientId"`
+	SentAt    time.Time `json:"sentAt"`
+}
+
+// sentJournal is the append-only record of sent messages selected by
+// JOURNAL: a Redis stream (JOURNAL_STREAM) or an NDJSON file (JOURNAL_FILE).
+// It is separate from every processing set and is never trimmed here.
+type sentJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var journal *sentJournal
+
+func openJournal() (*sentJournal, error) {
+	switch cfg.Journal {
+	case "":
+		return nil, nil
+	case "file":
+		if err := os.MkdirAll(filepath.Dir(cfg.JournalFile), 0o755); err != nil {
+			return nil, fmt.Errorf("error creating journal dir: %w", err)
+		}
+		file, err := os.OpenFile(cfg.JournalFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening journal file: %w", err)
+		}
+		return &sentJournal{file: file}, nil
+	default:
+		return &sentJournal{}, nil
+	}
+}
+
+func contentDedupID(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Record appends an entry. Failures are logged, not returned: the message
+// has already been sent and must not be reported as failed.
+func (j *sentJournal) Record(ctx context.Context, entry journalEntry) {
+	if j == nil {
+		return
+	}
+
+	if j.file == nil {
+		if suppressWrite("xadd", cfg.JournalStream, "fullUrl", entry.FullUrl, "messageId", entry.MessageID) {
+			return
+		}
+		_, err := redisRetry(ctx, "xadd "+cfg.JournalStream, func() (string, error) {
+			return redisClient.XAdd(ctx, &redis.XAddArgs{
+				Stream: cfg.JournalStream,
+				Values: map[string]interface{}{
+					"fullUrl":   entry.FullUrl,
+					"dedupId":   entry.DedupID,
+					"messageId": entry.MessageID,
+					"clientId":  entry.ClientID,
+					"sentAt":    entry.SentAt.Format(time.RFC3339Nano),
+				},
+			}).Result()
+		})
+		if err != nil {
+			slog.Error("Error writing sent message to journal", "fullUrl", entry.FullUrl, "error", err)
+		}
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Error encoding journal entry", "fullUrl", entry.FullUrl, "error", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Error writing sent message to journal", "fullUrl", entry.FullUrl, "error", err)
+	}
+}
+
+func (j *sentJournal) Close() {
+	if j == nil || j.file == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Sync(); err != nil {
+		slog.Error("Error syncing journal file", "error", err)
+	}
+	j.file.Close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsonCodec is the JSON implementation used on the hot paths: Bundle pages,
+// referenced resources, the reference cache and outgoing messages.
+// JSON_CODEC=jsoniter swaps in json-iterator, a drop-in replacement that
+// decodes large Bundles with noticeably less CPU; encoding/json stays the
+// default. STREAMING_PARSE always uses encoding/json's token decoder.
+type jsonCodec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type stdJSON struct{}
+
+func (stdJSON) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (stdJSON) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+var fastJSON jsonCodec = stdJSON{}
+
+func initJSONCodec() {
+	if cfg.JSONCodec == "jsoniter" {
+		fastJSON = jsoniter.ConfigCompatibleWithStandardLibrary
+	}
+}
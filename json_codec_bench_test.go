@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// BenchmarkBundleCodec decodes the same representative Bundle with each
+// JSON_CODEC, to weigh json-iterator against encoding/json.
+func BenchmarkBundleCodec(b *testing.B) {
+	body := bundleOfSize(b, 1000)
+	codecs := []struct {
+		name  string
+		codec jsonCodec
+	}{
+		{"std", stdJSON{}},
+		{"jsoniter", jsoniter.ConfigCompatibleWithStandardLibrary},
+	}
+	for _, c := range codecs {
+		b.Run(c.name, func(b *testing.B) {
+			saved := fastJSON
+			fastJSON = c.codec
+			defer func() { fastJSON = saved }()
+
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var bundle Bundle
+				if err := fastJSON.Unmarshal(body, &bundle); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Both scripts only touch the key while it still holds our token, so an
+// instance whose lock expired can never refresh or delete a newer owner's.
+var (
+	refreshLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// defaultLockKey scopes the lock to the FHIR server and, in backfill, to
+// START_DATE..END_DATE, so collectors for other servers or ranges do not
+// block each other. The other date modes walk the open-ended cursor.
+func defaultLockKey(c Config) string {
+	scope := c.FHIRBaseURL
+	if c.Mode == "backfill" {
+		scope += "|" + c.StartDate + ".." + c.EndDate
+	}
+	h := fnv.New64a()
+	h.Write([]byte(scope))
+	return fmt.Sprintf("collector_lock:%x", h.Sum64())
+}
+
+// runLock keeps a Redis key (SET NX with LOCK_TTL) for the lifetime of a
+// run so a second collector sharing the same cursor cannot start at the
+// same time.
+type runLock struct {
+	key   string
+	token string
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// acquireRunLock takes the lock, waiting up to LOCK_WAIT for the current
+// holder to finish. With the default LOCK_WAIT of 0 it fails immediately.
+func acquireRunLock(ctx context.Context) (*runLock, error) {
+	hostname, _ := os.Hostname()
+	lock := &runLock{
+		key:   cfg.LockKey,
+		token: fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano()),
+		ttl:   cfg.LockTTL,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	waitUntil := time.Now().Add(cfg.LockWait)
+	for {
+		acquired, err := redisClient.SetNX(ctx, lock.key, lock.token, lock.ttl).Result()
+		if err != nil {
+			return nil, fmt.Errorf("error acquiring lock %s: %w", lock.key, err)
+		}
+		if acquired {
+			break
+		}
+
+		holder, _ := redisClient.Get(ctx, lock.key).Result()
+		if !time.Now().Before(waitUntil) {
+			return nil, fmt.Errorf("lock %s is held by %s, another collector is running", lock.key, holder)
+		}
+		slog.Info("Lock held by another collector, waiting", "key", lock.key, "holder", holder)
+		time.Sleep(min(lock.ttl/3, time.Until(waitUntil)))
+	}
+
+	slog.Info("Lock acquired", "key", lock.key, "ttl", lock.ttl)
+	go lock.refresh(ctx)
+	return lock, nil
+}
+
+// refresh extends the TTL every third of it. Losing the lock means another
+// instance may already be processing, so the run is aborted rather than risk
+// sending the same encounters twice; main still flushes and exits non-zero.
+func (l *runLock) refresh(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			refreshed, err := refreshLockScript.Run(ctx, redisClient, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+			if err != nil {
+				slog.Error("Error refreshing lock", "key", l.key, "error", err)
+				continue
+			}
+			if refreshed == 0 {
+				abortRun(fmt.Errorf("lock %s was lost to another collector", l.key))
+				return
+			}
+		}
+	}
+}
+
+func (l *runLock) Release(ctx context.Context) {
+	close(l.stop)
+	<-l.done
+	if err := releaseLockScript.Run(ctx, redisClient, []string{l.key}, l.token).Err(); err != nil {
+		slog.Error("Error releasing lock", "key", l.key, "error", err)
+		return
+	}
+	slog.Info("Lock released", "key", l.key)
+}
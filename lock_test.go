@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDefaultLockKey(t *testing.T) {
+	base := Config{Mode: "catchup", FHIRBaseURL: "https://fhir.example.org/r4"}
+	otherServer := base
+	otherServer.FHIRBaseURL = "https://other.example.org/r4"
+	backfill := Config{Mode: "backfill", FHIRBaseURL: base.FHIRBaseURL, StartDate: "2024-01-01", EndDate: "2024-01-31"}
+	otherRange := backfill
+	otherRange.EndDate = "2024-02-29"
+
+	keys := map[string]string{}
+	for name, c := range map[string]Config{"base": base, "otherServer": otherServer, "backfill": backfill, "otherRange": otherRange} {
+		key := defaultLockKey(c)
+		if previous, ok := keys[key]; ok {
+			t.Errorf("%s and %s share lock key %s", name, previous, key)
+		}
+		keys[key] = name
+	}
+
+	continuous := base
+	continuous.Mode = "continuous"
+	if defaultLockKey(continuous) != defaultLockKey(base) {
+		t.Error("catchup and continuous on the same server must share the lock, they walk the same cursor")
+	}
+}
+
+func TestWithRunCancelAfterAbort(t *testing.T) {
+	resetRunAbort(t)
+	abortRun(errors.New("lock lost"))
+	ctx := withRunCancel(context.Background())
+	if ctx.Err() == nil {
+		t.Fatal("run context not cancelled for a run aborted before it was created")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// lookbackActive reports whether LOOKBACK_DAYS applies to this run: only
+// MODE=catchup and MODE=continuous move a forward-only cursor that late
+// edits can fall behind.
+func lookbackActive() bool {
+	return cfg.LookbackDays > 0 && (cfg.Mode == "catchup" || cfg.Mode == "continuous")
+}
+
+// runLookback searches, after the date range, for encounters updated in the
+// last LOOKBACK_DAYS days (_lastUpdated), whatever their period, to pick up
+// backdated encounters and edits to dates the cursor already passed.
+// Versions already sent are skipped by processEncounter.
+func runLookback(ctx context.Context) {
+	if !lookbackActive() || runAborted() != nil {
+		return
+	}
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -cfg.LookbackDays)
+	label := "lookback-" + since.Format("2006-01-02")
+	slog.Info("Re-querying recently updated encounters", "since", since.Format(time.RFC3339), "days", cfg.LookbackDays)
+	processingDate.Set(label)
+	ctx, endWatch := watchdog.Begin(ctx, label)
+	defer endWatch()
+
+	url := encounterSearchURL(fmt.Sprintf("%s/Encounter?_lastUpdated=ge%s", activeFHIRBase(), since.Format(time.RFC3339)))
+
+	var out *ndjsonWriter
+	if ndjsonSinkEnabled {
+		var err error
+		out, err = openNDJSONWriter(label)
+		if err != nil {
+			slog.Error("Erro ao abrir arquivo NDJSON", "error", err)
+			return
+		}
+	}
+	result, err := processEncounterSearch(ctx, url, out, nil, nil)
+	if out != nil {
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("falha ao finalizar arquivo NDJSON: %w", closeErr)
+		}
+	}
+	if err != nil {
+		slog.Error("Erro ao buscar encontros atualizados recentemente", "since", since.Format(time.RFC3339), "error", err)
+		abortOnFatal(err)
+		return
+	}
+	slog.Info("Lookback finished", "encounters", result.Entries, "pages", result.Pages)
+}
+
+// encounterVersion identifies the version of an encounter for the
+// already-sent check: meta.versionId, or meta.lastUpdated on servers without
+// versioning. Empty when the server sent neither.
+func encounterVersion(enc Encounter) string {
+	if enc.Meta.VersionID != "" {
+		return enc.Meta.VersionID
+	}
+	return enc.Meta.LastUpdated
+}
+
+func sentVersionKey(fullUrl string) string {
+	return "sent_version:" + fullUrl
+}
+
+// versionAlreadySent reports whether this version of the encounter was
+// already sent within the lookback window. Redis errors count as not sent,
+// so data is re-sent rather than lost.
+func versionAlreadySent(ctx context.Context, fullUrl string, enc Encounter) bool {
+	version := encounterVersion(enc)
+	if !lookbackActive() || version == "" {
+		return false
+	}
+	sent, err := redisRetry(ctx, "get sent_version", func() (string, error) {
+		return redisClient.Get(ctx, sentVersionKey(fullUrl)).Result()
+	})
+	if err != nil && err != redis.Nil {
+		slog.Error("Error reading sent version, sending again", "fullUrl", fullUrl, "error", err)
+		return false
+	}
+	return sent == version
+}
+
+// markVersionSent records the version just sent, kept one day longer than
+// the lookback window so the next run's re-query still finds it.
+func markVersionSent(ctx context.Context, fullUrl string, enc Encounter) {
+	version := encounterVersion(enc)
+	if !lookbackActive() || version == "" {
+		return
+	}
+	if suppressWrite("set", sentVersionKey(fullUrl), "value", version) {
+		return
+	}
+	ttl := time.Duration(cfg.LookbackDays+1) * 24 * time.Hour
+	if _, err := redisRetry(ctx, "set sent_version", func() (string, error) {
+		return redisClient.Set(ctx, sentVersionKey(fullUrl), version, ttl).Result()
+	}); err != nil {
+		slog.Error("Error recording sent version", "fullUrl", fullUrl, "error", err)
+	}
+}
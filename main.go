@@ -3,11 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,82 +26,297 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/go-redis/redis/v8"
 	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	redisClient *redis.Client
+
+	lastDateEntryCount int
+
+	runDeadline time.Time
 )
 
 type Encounter struct {
 	ResourceType string `json:"resourceType"`
 	ID           string `json:"id"`
-	Status       string `json:"status"`
-	Class        struct {
+	Meta         struct {
+		VersionID   string   `json:"versionId"`
+		LastUpdated string   `json:"lastUpdated"`
+		Profile     []string `json:"profile"`
+	} `json:"meta"`
+	Status string `json:"status"`
+	Class  struct {
 		System string `json:"system"`
 		Code   string `json:"code"`
 	} `json:"class"`
+	Type   []CodeableConcept `json:"type"`
 	Period struct {
-		Start time.Time `json:"start"`
-		End   time.Time `json:"end"`
+		Start fhirDateTime `json:"start"`
+		End   fhirDateTime `json:"end"`
 	} `json:"period"`
-	Participant []struct {
-		Individual struct {
-			Reference string `json:"reference"`
-		} `json:"individual"`
-	} `json:"participant"`
-	Subject struct {
+	Participant []EncounterParticipant `json:"participant"`
+	Subject     struct {
 		Reference string `json:"reference"`
 	} `json:"subject"`
+	ServiceProvider struct {
+		Reference string `json:"reference"`
+	} `json:"serviceProvider"`
+
+	// missingElements are the ENCOUNTER_PROFILE_ELEMENTS the resource
+	// lacks, found while decoding it.
+	missingElements []string
+}
+
+// EncounterParticipant is one Encounter.participant: who took part, in
+// which role (type, e.g. ATND attender or ADM admitter) and when.
+type EncounterParticipant struct {
+	Type   []CodeableConcept `json:"type"`
+	Period struct {
+		Start fhirDateTime `json:"start"`
+		End   fhirDateTime `json:"end"`
+	} `json:"period"`
+	Individual struct {
+		Reference string `json:"reference"`
+	} `json:"individual"`
+}
+
+// typeCoding returns the participant's type coding with the given code.
+func (p EncounterParticipant) typeCoding(code string) (Coding, bool) {
+	for _, concept := range p.Type {
+		for _, coding := range concept.Coding {
+			if coding.Code == code {
+				return coding, true
+			}
+		}
+	}
+	return Coding{}, false
+}
+
+// Role returns the participant's type coding listed first in
+// PARTICIPANT_TYPE_PRIORITY, or its first type coding otherwise.
+func (p EncounterParticipant) Role() (Coding, bool) {
+	for _, code := range cfg.ParticipantTypePriorityList() {
+		if coding, ok := p.typeCoding(code); ok {
+			return coding, true
+		}
+	}
+	if len(p.Type) > 0 {
+		return p.Type[0].FirstCoding()
+	}
+	return Coding{}, false
 }
 
 type EncounterDB struct {
 	FhirId         string `json:"fhirId"`
 	FullUrl        string `json:"fullUrl"`
 	Status         string `json:"status"`
+	RawStatus      string `json:"rawStatus,omitempty"`
 	Class          string `json:"class"`
+	TypeSystem     string `json:"typeSystem,omitempty"`
+	TypeCode       string `json:"typeCode,omitempty"`
+	TypeDisplay    string `json:"typeDisplay,omitempty"`
 	Period         Period `json:"period"`
 	PractitionerId string `json:"practitionerId"`
 	PatientId      string `json:"patientId"`
+	// The role and period of the participant chosen as the practitioner.
+	ParticipantTypeSystem  string  `json:"participantTypeSystem,omitempty"`
+	ParticipantTypeCode    string  `json:"participantTypeCode,omitempty"`
+	ParticipantTypeDisplay string  `json:"participantTypeDisplay,omitempty"`
+	ParticipantPeriod      *Period `json:"participantPeriod,omitempty"`
+	// MissingReferences lists the references that returned 404 when
+	// MISSING_REFERENCE=skip; their resources carry only the ID.
+	MissingReferences []string `json:"missingReferences,omitempty"`
+	// LastUpdated is meta.lastUpdated, with CAPTURE_LAST_UPDATED.
+	LastUpdated *time.Time `json:"lastUpdated,omitempty"`
 }
 
 type Period struct {
 	Start time.Time `json:"start"`
 	End   time.Time `json:"end,omitempty"`
+	// StartOffset and EndOffset keep the UTC offset the server sent (e.g.
+	// -03:00) when PERIOD_TIMEZONE converts the timestamps and
+	// KEEP_PERIOD_OFFSET is on.
+	StartOffset string `json:"startOffset,omitempty"`
+	EndOffset   string `json:"endOffset,omitempty"`
 }
 
 type Bundle struct {
-	Entry []struct {
-		FullUrl  string    `json:"fullUrl"`
-		Resource Encounter `json:"resource"`
-	} `json:"entry"`
+	Type  string `json:"type"`
+	Total int    `json:"total"`
+	Link  []struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	} `json:"link"`
+	Entry []BundleEntry `json:"entry"`
+}
+
+// BundleEntry is decoded by the resource's resourceType (see
+// UnmarshalJSON): searches with _include return the referenced resources
+// alongside the matched Encounters.
+type BundleEntry struct {
+	FullUrl      string
+	ResourceType string
+	Resource     Encounter
+
+	// Practitioner and Patient hold an entry included by _include.
+	Practitioner *Practitioner
+	Patient      *Patient
+
+	// Base is the FHIR server that returned the entry, against which its
+	// relative references are resolved.
+	Base string `json:"-"`
+}
+
+func (b Bundle) NextLink() string {
+	for _, link := range b.Link {
+		if link.Relation == "next" {
+			return link.URL
+		}
+	}
+	return ""
+}
+
+type Coding struct {
+	System  string `json:"system"`
+	Code    string `json:"code"`
+	Display string `json:"display"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding"`
+	Text   string   `json:"text"`
+}
+
+func (c CodeableConcept) FirstCoding() (Coding, bool) {
+	if len(c.Coding) == 0 {
+		return Coding{}, false
+	}
+	return c.Coding[0], true
+}
+
+// resourceMeta is the part of a referenced resource's meta this service
+// reads.
+type resourceMeta struct {
+	LastUpdated string `json:"lastUpdated"`
 }
 
 type Practitioner struct {
-	ResourceType string `json:"resourceType"`
-	ID           string `json:"id"`
+	ResourceType string       `json:"resourceType"`
+	ID           string       `json:"id"`
+	Meta         resourceMeta `json:"meta"`
 	Name         []struct {
 		Family string   `json:"family"`
 		Given  []string `json:"given"`
 	} `json:"name"`
+	Qualification []struct {
+		Code CodeableConcept `json:"code"`
+	} `json:"qualification"`
 }
 
 type PractitionerDB struct {
-	FhirId     string `json:"fhirId"`
-	GivenName  string `json:"givenName"`
-	FamilyName string `json:"familyName"`
+	FhirId               string `json:"fhirId"`
+	GivenName            string `json:"givenName"`
+	FamilyName           string `json:"familyName"`
+	QualificationCode    string `json:"qualificationCode,omitempty"`
+	QualificationDisplay string `json:"qualificationDisplay,omitempty"`
+	SpecialtyCode        string `json:"specialtyCode,omitempty"`
+	SpecialtyDisplay     string `json:"specialtyDisplay,omitempty"`
+	// LastUpdated is meta.lastUpdated, with CAPTURE_LAST_UPDATED.
+	LastUpdated *time.Time `json:"lastUpdated,omitempty"`
 }
 
 type Patient struct {
-	ResourceType string `json:"resourceType"`
-	ID           string `json:"id"`
+	ResourceType string       `json:"resourceType"`
+	ID           string       `json:"id"`
+	Meta         resourceMeta `json:"meta"`
 	Name         []struct {
 		Family string   `json:"family"`
 		Given  []string `json:"given"`
 	} `json:"name"`
-	BirthDate string `json:"birthDate"`
-	Gender    string `json:"gender"`
+	BirthDate            string `json:"birthDate"`
+	Gender               string `json:"gender"`
+	ManagingOrganization struct {
+		Reference string `json:"reference"`
+	} `json:"managingOrganization"`
+	Address []Address `json:"address"`
+	// deceased[x] is either a boolean or the date and time of death.
+	DeceasedBoolean  *bool  `json:"deceasedBoolean"`
+	DeceasedDateTime string `json:"deceasedDateTime"`
+	Telecom          []struct {
+		System string `json:"system"`
+		Value  string `json:"value"`
+		Use    string `json:"use"`
+		Rank   int    `json:"rank"`
+	} `json:"telecom"`
+}
+
+type Address struct {
+	Use        string `json:"use"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+}
+
+// PreferredContacts returns the phone and email to send: the lowest rank
+// wins, and among equal ranks a home contact over any other use.
+func (p Patient) PreferredContacts() (phone string, email string) {
+	best := map[string]int{}
+	for i, contact := range p.Telecom {
+		if contact.Value == "" || contact.Use == "old" {
+			continue
+		}
+		previous, found := best[contact.System]
+		if !found || contactBefore(contact.Rank, contact.Use, p.Telecom[previous].Rank, p.Telecom[previous].Use) {
+			best[contact.System] = i
+		}
+	}
+	if i, ok := best["phone"]; ok {
+		phone = p.Telecom[i].Value
+	}
+	if i, ok := best["email"]; ok {
+		email = p.Telecom[i].Value
+	}
+	return phone, email
+}
+
+// contactBefore orders ContactPoints; rank 0 means unranked and sorts last.
+func contactBefore(rank int, use string, otherRank int, otherUse string) bool {
+	if rank != otherRank {
+		return otherRank == 0 || (rank != 0 && rank < otherRank)
+	}
+	return use == "home" && otherUse != "home"
+}
+
+// PreferredAddress returns the home address, falling back to the first one
+// listed.
+func (p Patient) PreferredAddress() (Address, bool) {
+	for _, address := range p.Address {
+		if address.Use == "home" {
+			return address, true
+		}
+	}
+	if len(p.Address) == 0 {
+		return Address{}, false
+	}
+	return p.Address[0], true
+}
+
+// DeceasedStatus reads deceased[x]: a dateTime means the patient died then,
+// a boolean is taken as is, and no value means not deceased.
+func (p Patient) DeceasedStatus() (bool, string) {
+	if p.DeceasedDateTime != "" {
+		return true, p.DeceasedDateTime
+	}
+	return p.DeceasedBoolean != nil && *p.DeceasedBoolean, ""
 }
 
 type PatientDB struct {
@@ -100,38 +325,248 @@ type PatientDB struct {
 	FamilyName string `json:"familyName"`
 	BirthDate  string `json:"birthDate"`
 	Gender     string `json:"gender"`
+	// ManagingOrganization is the Organization reference used by
+	// PARTITION_BY=organization.
+	ManagingOrganization string `json:"managingOrganization,omitempty"`
+	City                 string `json:"city,omitempty"`
+	State                string `json:"state,omitempty"`
+	PostalCode           string `json:"postalCode,omitempty"`
+	Country              string `json:"country,omitempty"`
+	// Phone and Email are only filled with CAPTURE_TELECOM and are redacted
+	// from logs.
+	Phone string `json:"phone,omitempty" secret:"true"`
+	Email string `json:"email,omitempty" secret:"true"`
+	// Deceased is false when the patient has no deceased[x];
+	// DeceasedDateTime is only set when the server sent the date.
+	Deceased         bool   `json:"deceased"`
+	DeceasedDateTime string `json:"deceasedDateTime,omitempty"`
+	// LastUpdated is meta.lastUpdated, with CAPTURE_LAST_UPDATED.
+	LastUpdated *time.Time `json:"lastUpdated,omitempty"`
 }
 
 type FHIRMessage struct {
 	Encounter    EncounterDB    `json:"encounter"`
 	Practitioner PractitionerDB `json:"practitioner"`
 	Patient      PatientDB      `json:"patient"`
+
+	// With DEDUP_REFERENCES, a practitioner or patient already sent in this
+	// run carries only its ID and is flagged as omitted.
+	PractitionerOmitted bool `json:"practitionerOmitted,omitempty"`
+	PatientOmitted      bool `json:"patientOmitted,omitempty"`
+
+	// Source is the server the encounter was read from, with
+	// INCLUDE_SOURCE.
+	Source *MessageSource `json:"source,omitempty"`
+
+	PractitionerMissing bool `json:"-"`
+	PatientMissing      bool `json:"-"`
+}
+
+var (
+	errNotModified       = errors.New("resource not modified")
+	errInvalidReference  = errors.New("referenced resource is missing required fields")
+	errReferenceMismatch = errors.New("referenced resource has a different ID than the reference")
+)
+
+type statusError struct {
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("API returned status %d", e.StatusCode)
+}
+
+type cacheValidators struct {
+	ETag         string
+	LastModified string
 }
 
 func fetchData(ctx context.Context, url string) ([]byte, error) {
-	log.Printf("Making request to URL: %s", url)
+	body, _, err := fetchDataConditional(ctx, url, cacheValidators{})
+	return body, err
+}
+
+// fetchDataConditional sends If-None-Match/If-Modified-Since when validators
+// are known and returns errNotModified on a 304 response.
+func fetchDataConditional(ctx context.Context, url string, validators cacheValidators) ([]byte, cacheValidators, error) {
+	resp, err := openResponse(ctx, url, validators)
+	if errors.Is(err, errNotModified) {
+		return nil, validators, err
+	}
+	if err != nil {
+		return nil, cacheValidators{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.MaxResponseBytes+1))
+	if err != nil {
+		return nil, cacheValidators{}, fmt.Errorf("error reading API response: %w", err)
+	}
+	if int64(len(body)) > cfg.MaxResponseBytes {
+		return nil, cacheValidators{}, fmt.Errorf("API response exceeds MAX_RESPONSE_BYTES (%d bytes)", cfg.MaxResponseBytes)
+	}
+
+	return body, cacheValidators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// openResponse performs the GET and checks status and content type, leaving
+// the body unread for the caller to consume and close.
+func openResponse(ctx context.Context, url string, validators cacheValidators) (*http.Response, error) {
+	slog.Debug("Making request", "url", url)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
+	req.Header.Set("Accept", "application/fhir+json")
+	if cfg.PreferHandling != "" {
+		// handling=strict asks the server to reject search parameters it does
+		// not support instead of silently ignoring them.
+		req.Header.Set("Prefer", "handling="+cfg.PreferHandling)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
 
-	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := fhirClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error calling API: %w", err)
 	}
-	defer resp.Body.Close()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, errNotModified
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, &statusError{StatusCode: resp.StatusCode}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !isJSONContentType(contentType) {
+		prefix, _ := io.ReadAll(io.LimitReader(resp.Body, 120))
+		resp.Body.Close()
+		return nil, fmt.Errorf("API returned content type %q instead of JSON, body starts with %q", contentType, prefix)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	return resp, nil
+}
+
+// isJSONContentType accepts application/json, application/fhir+json and the
+// legacy application/json+fhir used by older FHIR servers.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return nil, fmt.Errorf("error reading API response: %w", err)
+		return false
+	}
+	return mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		mediaType == "application/json+fhir"
+}
+
+// encounterSearchURL adds the configured _sort and _elements to an Encounter
+// search. Without a stable sort the server may reorder results between page
+// requests, so following next links can skip or repeat encounters.
+func encounterSearchURL(rawURL string) string {
+	if cfg.SearchSort != "none" {
+		rawURL = withParam(rawURL, "_sort", cfg.SearchSort)
+	}
+	rawURL = withParam(rawURL, "_summary", cfg.EncounterSummary)
+	return withElements(rawURL, cfg.EncounterElements)
+}
+
+func withElements(rawURL string, elements string) string {
+	return withParam(rawURL, "_elements", elements)
+}
+
+func withParam(rawURL string, key string, value string) string {
+	if value == "" {
+		return rawURL
+	}
+	separator := "?"
+	if strings.Contains(rawURL, "?") {
+		separator = "&"
+	}
+	return rawURL + separator + key + "=" + url.QueryEscape(value)
+}
+
+// mergeElements appends the fields the parser depends on to a configured
+// _elements list, so a trimmed response never drops them.
+func mergeElements(configured string, required string) string {
+	if configured == "" {
+		return ""
+	}
+	elements := strings.Split(configured, ",")
+	for _, field := range strings.Split(required, ",") {
+		found := false
+		for _, element := range elements {
+			if strings.TrimSpace(element) == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			elements = append(elements, field)
+		}
 	}
+	return strings.Join(elements, ",")
+}
 
-	return body, nil
+// referenceType returns the resource type of a relative or absolute
+// reference such as "Practitioner/123", or "" when it has none.
+func referenceType(ref string) string {
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+// selectPractitioner returns the participant whose reference type is in
+// PRACTITIONER_REFERENCE_TYPES and whose role comes first in
+// PARTICIPANT_TYPE_PRIORITY, or the first such participant when none has a
+// listed role. Participants of other types (RelatedPerson, Device, ...) are
+// skipped and the encounter is recorded in non_practitioner_participants,
+// since fetching them from the Practitioner endpoint would only 404.
+func selectPractitioner(ctx context.Context, enc Encounter, fullUrl string) (EncounterParticipant, bool) {
+	allowed := cfg.PractitionerReferenceTypeList()
+	skipped := false
+	var candidates []EncounterParticipant
+	for _, participant := range enc.Participant {
+		ref := participant.Individual.Reference
+		if ref == "" {
+			continue
+		}
+		if slices.Contains(allowed, referenceType(ref)) {
+			candidates = append(candidates, participant)
+			continue
+		}
+		slog.Debug("Skipping non-practitioner participant", "encounter", enc.ID, "reference", ref)
+		skipped = true
+	}
+
+	if len(candidates) == 0 {
+		if skipped {
+			flagEncounter(ctx, "non_practitioner_participants", fullUrl)
+		}
+		return EncounterParticipant{}, false
+	}
+	for _, role := range cfg.ParticipantTypePriorityList() {
+		for _, participant := range candidates {
+			if _, ok := participant.typeCoding(role); ok {
+				return participant, true
+			}
+		}
+	}
+	return candidates[0], true
 }
 
 func extractReferenceID(ref string) string {
@@ -142,307 +577,1330 @@ func extractReferenceID(ref string) string {
 	return ref
 }
 
-func processEncounter(ctx context.Context, enc Encounter, fullUrl string, clientID string) {
-	if enc.Status == "" || enc.Class.Code == "" || enc.Participant == nil || enc.Subject.Reference == "" || fullUrl == "" {
-		log.Printf("Invalid encounter found, adding to invalid_encounters set: %s", fullUrl)
-		_, err := redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+// clientIDForPatient maps a patient to a stable FIFO message group so all of
+// their encounters keep their order across dates.
+func clientIDForPatient(patientId string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(patientId))
+	return fmt.Sprintf("%03d", hash.Sum32()%uint32(cfg.ClientPartitions)+1)
+}
+
+// processEncounter reports whether the encounter reached every enabled sink.
+func processEncounter(ctx context.Context, enc Encounter, base string, fullUrl string, out *ndjsonWriter) (sent bool) {
+	ctx, span := tracer.Start(ctx, "processEncounter", trace.WithAttributes(
+		attribute.String("fhir_id", enc.ID),
+		attribute.String("full_url", fullUrl),
+		attribute.String("status", enc.Status),
+	))
+	defer span.End()
+
+	if cfg.EncounterSummary != "" && enc.ID != "" && !summaryComplete(enc) {
+		full, err := fetchFullEncounter(ctx, base, enc.ID)
 		if err != nil {
-			log.Printf("Error adding to invalid_encounters: %v", err)
+			slog.Error("Erro ao buscar encontro completo", "fullUrl", fullUrl, "error", err)
+			emitErrorEvent(ctx, failurePhase(err), "Encounter/"+enc.ID, fullUrl, err)
+			flagEncounter(ctx, "invalid_encounters", fullUrl)
+			return
 		}
+		enc = full
+	}
+
+	// With LOOKBACK_DAYS the same version reaches the run from both the
+	// date search and the lookback search; it is sent once.
+	if versionAlreadySent(ctx, fullUrl, enc) {
+		slog.Debug("Encounter version already sent, skipping", "fullUrl", fullUrl, "version", encounterVersion(enc))
+		stats.update(func(s *runStats) { s.AlreadySent++ })
 		return
 	}
 
-	practitionerRef := enc.Participant[0].Individual.Reference
-	if practitionerRef == "" {
-		log.Printf("Nenhuma referência de practitioner encontrada para encontro: %s", enc.ID)
+	// ENCOUNTER_ONLY never resolves the practitioner, so it does not need one.
+	if enc.Status == "" || enc.Class.Code == "" || (enc.Participant == nil && !cfg.EncounterOnly) || enc.Subject.Reference == "" || fullUrl == "" {
+		slog.Warn("Invalid encounter found, adding to invalid_encounters set", "fullUrl", fullUrl)
+		flagEncounter(ctx, "invalid_encounters", fullUrl)
 		return
 	}
-	practitionerId := extractReferenceID(enc.Participant[0].Individual.Reference)
 
-	patientRef := enc.Subject.Reference
-	if patientRef == "" {
-		log.Printf("Nenhuma referência de paciente encontrada para encontro: %s", enc.ID)
+	if err := invalidPeriodError(enc); err != nil {
+		slog.Warn("Encounter with unparseable period, adding to invalid_encounters set", "fullUrl", fullUrl, "error", err)
+		emitErrorEvent(ctx, "parse", "Encounter/"+enc.ID, fullUrl, err)
+		flagEncounter(ctx, "invalid_encounters", fullUrl)
 		return
 	}
-	patientId := extractReferenceID(enc.Subject.Reference)
 
-	encParsed := EncounterDB{
-		FhirId:  enc.ID,
-		FullUrl: fullUrl,
-		Status:  enc.Status,
-		Class:   enc.Class.Code,
-		Period: Period{
-			Start: enc.Period.Start,
-			End:   enc.Period.End,
-		},
-		PractitionerId: practitionerId,
-		PatientId:      patientId,
-	}
-
-	practitionerURL := fmt.Sprintf("https://hapi.fhir.org/baseR4/%s", practitionerRef)
-	log.Printf("Buscando practitioner de: %s", practitionerURL)
-	practitionerData, err := fetchDataWithRetry(ctx, practitionerURL, 3)
-	if err != nil {
-		log.Printf("Erro ao buscar practitioner após 3 tentativas: %v", err)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	if outsideAttributedDate(ctx, enc, fullUrl) {
+		slog.Debug("Encounter attributed to another date, skipping", "fullUrl", fullUrl, "start", enc.Period.Start.Raw)
+		outsideDateEncountersTotal.Add(1)
+		stats.update(func(s *runStats) { s.OutsideDate++ })
 		return
 	}
 
-	var practitioner Practitioner
-	if err := json.Unmarshal(practitionerData, &practitioner); err != nil {
-		log.Printf("Erro ao parsear JSON do practitioner: %v", err)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	if err := profileError(enc); err != nil {
+		slog.Warn("Encounter does not conform to ENCOUNTER_PROFILE, adding to profile_invalid set", "fullUrl", fullUrl, "error", err)
+		flagEncounter(ctx, "profile_invalid", fullUrl)
 		return
 	}
 
-	if !(len(practitioner.Name) > 0 && len(practitioner.Name[0].Given) > 0) {
-		log.Printf("Practitioner inválido: %s", practitionerRef)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	// entered-in-error encounters are retracted data and never sent unless
+	// INGEST_ENTERED_IN_ERROR is on.
+	if enc.Status == "entered-in-error" && !cfg.IngestEnteredInError {
+		slog.Info("Dropping entered-in-error encounter", "fullUrl", fullUrl)
+		flagEncounter(ctx, "entered_in_error_encounters", fullUrl)
 		return
 	}
 
-	practitionerParsed := PractitionerDB{
-		FhirId:     practitioner.ID,
-		GivenName:  practitioner.Name[0].Given[0],
-		FamilyName: practitioner.Name[0].Family,
+	// Filtered statuses are dropped before any reference is fetched.
+	if !statusIncluded(enc.Status) {
+		slog.Debug("Encounter status filtered out", "fullUrl", fullUrl, "status", enc.Status)
+		filteredEncountersTotal.Add(1)
+		stats.update(func(s *runStats) { s.EncountersFiltered++ })
+		return
 	}
 
-	patientURL := fmt.Sprintf("https://hapi.fhir.org/baseR4/%s", patientRef)
-	log.Printf("Buscando paciente de: %s", patientURL)
-	patientData, err := fetchDataWithRetry(ctx, patientURL, 3)
-	if err != nil {
-		log.Printf("Erro ao buscar paciente após 3 tentativas: %v", err)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	participant, found := selectPractitioner(ctx, enc, fullUrl)
+	practitionerRef := participant.Individual.Reference
+	if !found && !cfg.EncounterOnly {
+		slog.Warn("Nenhuma referência de practitioner encontrada para encontro", "encounter", enc.ID)
+		flagEncounter(ctx, "no_practitioner_encounters", fullUrl)
 		return
 	}
+	practitionerId := extractReferenceID(practitionerRef)
 
-	var patient Patient
-	if err := json.Unmarshal(patientData, &patient); err != nil {
-		log.Printf("Erro ao parsear JSON do paciente: %v", err)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	patientRef := enc.Subject.Reference
+	if patientRef == "" {
+		slog.Warn("Nenhuma referência de paciente encontrada para encontro", "encounter", enc.ID)
 		return
 	}
+	patientId := extractReferenceID(enc.Subject.Reference)
 
-	if !(len(patient.Name) > 0 && len(patient.Name[0].Given) > 0) {
-		log.Printf("Patient inválido: %s", practitionerRef)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	encParsed := toEncounterDB(enc, fullUrl, practitionerId, patientId)
+	if found {
+		setParticipant(&encParsed, participant)
+	}
+	if periodLocation != nil {
+		encParsed.Period = normalizePeriod(encParsed.Period, periodLocation, cfg.KeepPeriodOffset)
+	}
+	encParsed.Status = normalizeStatus(ctx, enc.Status, fullUrl)
+	if cfg.KeepRawStatus {
+		encParsed.RawStatus = enc.Status
+	}
+
+	if !encParsed.Period.End.IsZero() && encParsed.Period.End.Before(encParsed.Period.Start) {
+		slog.Warn("Encounter period ends before it starts", "fullUrl", fullUrl, "start", encParsed.Period.Start, "end", encParsed.Period.End, "policy", cfg.PeriodEndBeforeStart)
+		switch cfg.PeriodEndBeforeStart {
+		case "drop_end":
+			encParsed.Period.End = time.Time{}
+		case "flag":
+			flagEncounter(ctx, "suspect_encounters", fullUrl)
+		case "invalidate":
+			flagEncounter(ctx, "invalid_encounters", fullUrl)
+			return
+		}
+	}
+
+	// Sub-threshold periods are artifacts of some sources; open periods are
+	// never filtered.
+	if cfg.MinEncounterDuration > 0 && !encParsed.Period.Start.IsZero() && !encParsed.Period.End.IsZero() &&
+		encParsed.Period.End.Sub(encParsed.Period.Start) < cfg.MinEncounterDuration {
+		slog.Debug("Encounter shorter than MIN_ENCOUNTER_DURATION", "fullUrl", fullUrl, "duration", encParsed.Period.End.Sub(encParsed.Period.Start))
+		filteredEncountersTotal.Add(1)
+		flagEncounter(ctx, "filtered_encounters", fullUrl)
 		return
 	}
 
-	patientParsed := PatientDB{
-		FhirId:     patient.ID,
-		GivenName:  patient.Name[0].Given[0],
-		FamilyName: patient.Name[0].Family,
-		BirthDate:  patient.BirthDate,
-		Gender:     patient.Gender,
+	// With ENCOUNTER_ONLY the practitioner and patient carry just the IDs
+	// taken from the references and nothing is fetched.
+	practitionerParsed := PractitionerDB{FhirId: practitionerId}
+	patientParsed := PatientDB{FhirId: patientId}
+	practitionerMissing, patientMissing := false, false
+	if !cfg.EncounterOnly {
+		var err error
+		practitionerParsed, err = resolvePractitioner(ctx, base, practitionerRef)
+		if err != nil {
+			abortOnFatal(err)
+			if !skipMissingReference(ctx, practitionerRef, err) {
+				emitErrorEvent(ctx, failurePhase(err), practitionerRef, fullUrl, err)
+				flagUnresolvedReference(ctx, fullUrl, err)
+				return
+			}
+			practitionerParsed = PractitionerDB{FhirId: practitionerId}
+			practitionerMissing = true
+			encParsed.MissingReferences = append(encParsed.MissingReferences, practitionerRef)
+		}
+
+		patientParsed, err = resolvePatient(ctx, base, patientRef)
+		if err != nil {
+			abortOnFatal(err)
+			if !skipMissingReference(ctx, patientRef, err) {
+				emitErrorEvent(ctx, failurePhase(err), patientRef, fullUrl, err)
+				flagUnresolvedReference(ctx, fullUrl, err)
+				return
+			}
+			patientParsed = PatientDB{FhirId: patientId}
+			patientMissing = true
+			encParsed.MissingReferences = append(encParsed.MissingReferences, patientRef)
+		}
 	}
 
+	clientID := clientIDForMessage(enc, patientParsed, patientId)
+
 	message := FHIRMessage{
 		Encounter:    encParsed,
 		Practitioner: practitionerParsed,
 		Patient:      patientParsed,
+
+		PractitionerMissing: practitionerMissing,
+		PatientMissing:      patientMissing,
+	}
+	if cfg.IncludeSource {
+		message.Source = messageSource(base)
+	}
+
+	jsonMsg, _ := json.MarshalIndent(redactSecretFields(message), "", "  ")
+	slog.Debug("Mensagem sendo enviada", "message", string(jsonMsg))
+
+	// With MESSAGE_FORMAT=patient the encounter waits in the window's batch
+	// and is sent, and counted, when the window's search completes.
+	if cfg.MessageFormat == "patient" {
+		batch := activePatientBatch
+		if batch == nil {
+			batch = newPatientBatch("")
+			batch.Add(message, enc, base, clientID)
+			return batch.Flush(ctx, out) > 0
+		}
+		batch.Add(message, enc, base, clientID)
+		return true
 	}
 
-	jsonMsg, err := json.MarshalIndent(message, "", "  ")
-	log.Printf("Mensagem sendo enviada: %v", string(jsonMsg))
+	if out != nil {
+		if err := out.Write(message); err != nil {
+			slog.Error("Erro ao escrever mensagem no arquivo NDJSON", "error", err)
+		}
+	}
 
-	if err := sendToSQS(ctx, message, clientID); err != nil {
-		log.Printf("Erro ao enviar mensagem para SQS: %v", err)
-		redisClient.SAdd(ctx, "invalid_encounters", fullUrl).Result()
+	if sqsSinkEnabled {
+		if err := sendMessage(ctx, message, clientID); err != nil {
+			recordSendFailure(ctx, "Encounter/"+enc.ID, []string{fullUrl}, err)
+			return
+		}
 	}
+	markVersionSent(ctx, fullUrl, enc)
+	stats.update(func(s *runStats) { s.EncountersSent++ })
+	return true
 }
 
-func sendToSQS(ctx context.Context, message FHIRMessage, clientID string) error {
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion("sa-east-1"),
+// recordSendFailure records a message that could not be sent against each
+// encounter it carried.
+func recordSendFailure(ctx context.Context, resource string, fullUrls []string, err error) {
+	// A schema violation is a transformation bug in this message, not a
+	// delivery failure, so it neither counts as invalid nor aborts the run.
+	if errors.Is(err, errSchemaInvalid) {
+		slog.Error("Mensagem não confere com MESSAGE_SCHEMA, não enviada", "resource", resource, "error", err)
+		for _, fullUrl := range fullUrls {
+			emitErrorEvent(ctx, "schema", resource, fullUrl, err)
+			flagEncounter(ctx, "schema_invalid", fullUrl)
+		}
+		return
+	}
+	// Likewise, an oversized message would be refused on every attempt and
+	// says nothing about SQS itself.
+	if errors.Is(err, errMessageOversized) {
+		slog.Error("Mensagem excede o limite de tamanho do SQS, não enviada", "resource", resource, "error", err)
+		for _, fullUrl := range fullUrls {
+			emitErrorEvent(ctx, "send", resource, fullUrl, err)
+			flagEncounter(ctx, "oversized_messages", fullUrl)
+		}
+		return
+	}
+	slog.Error("Erro ao enviar mensagem para SQS", "resource", resource, "error", err)
+	for _, fullUrl := range fullUrls {
+		emitErrorEvent(ctx, "send", resource, fullUrl, err)
+		flagEncounter(ctx, "invalid_encounters", fullUrl)
+	}
+	// The SDK already retried, so an error here is a persistent rejection.
+	if cfg.FailFast {
+		abortRun(fmt.Errorf("envio ao SQS falhou para %s: %w", strings.Join(fullUrls, ", "), err))
+	}
+}
+
+// flagUnresolvedReference records an encounter whose practitioner or patient
+// could not be used: an ID mismatch goes to reference_mismatch_encounters,
+// anything else to invalid_encounters.
+func flagUnresolvedReference(ctx context.Context, fullUrl string, err error) {
+	set := "invalid_encounters"
+	if errors.Is(err, errReferenceMismatch) {
+		set = "reference_mismatch_encounters"
+	}
+	flagEncounter(ctx, set, fullUrl)
+}
+
+// skipMissingReference reports whether an encounter should still be sent
+// despite err: with MISSING_REFERENCE=skip a reference the server answered
+// with 404 (now or in an earlier run, via REFERENCE_CACHE) is recorded in
+// missing_references and left unresolved, while any other failure still
+// invalidates the encounter.
+func skipMissingReference(ctx context.Context, reference string, err error) bool {
+	if cfg.MissingReference != "skip" || !isReferenceNotFound(err) {
+		return false
+	}
+	slog.Warn("Referência não encontrada, enviando encontro sem o recurso", "reference", reference)
+	flagEncounter(ctx, "missing_references", reference)
+	return true
+}
+
+func resolvePractitioner(ctx context.Context, base string, practitionerRef string) (PractitionerDB, error) {
+	var practitionerParsed PractitionerDB
+	state, err := lookupCachedReference(ctx, practitionerRef, &practitionerParsed)
+	if err == nil && state == referenceCached {
+		return practitionerParsed, nil
+	}
+	if state == referenceAbsent {
+		slog.Debug("Practitioner conhecido como ausente", "reference", practitionerRef)
+		return PractitionerDB{}, errReferenceAbsent
+	}
+
+	base, relative := splitReference(base, practitionerRef)
+	practitionerURL := withElements(fmt.Sprintf("%s/%s", base, relative), cfg.PractitionerElements)
+	slog.Debug("Buscando practitioner", "url", practitionerURL)
+	practitionerData, err := fetchReferenceWithRetry(ctx, practitionerURL, cfg.FetchMaxRetries)
+	if err != nil {
+		slog.Error("Erro ao buscar practitioner após retentativas", "attempts", cfg.FetchMaxRetries, "error", err)
+		markReferenceAbsentOnNotFound(ctx, practitionerRef, err)
+		return PractitionerDB{}, err
+	}
+
+	var practitioner Practitioner
+	if err := fastJSON.Unmarshal(practitionerData, &practitioner); err != nil {
+		slog.Error("Erro ao parsear JSON do practitioner", "error", err)
+		return PractitionerDB{}, fmt.Errorf("%w: %v", errResponseParse, err)
+	}
+
+	if practitioner.ID != extractReferenceID(practitionerRef) {
+		slog.Warn("Practitioner retornado com ID diferente da referência", "reference", practitionerRef, "id", practitioner.ID)
+		return PractitionerDB{}, errReferenceMismatch
+	}
+
+	practitionerParsed, err = parsePractitioner(ctx, base, practitionerRef, practitioner)
+	if err != nil {
+		return PractitionerDB{}, err
+	}
+	storeCachedReference(ctx, practitionerRef, practitionerParsed)
+	return practitionerParsed, nil
+}
+
+// parsePractitioner validates a fetched Practitioner and maps it to the
+// message struct, looking up its specialty with RESOLVE_PRACTITIONER_ROLE.
+func parsePractitioner(ctx context.Context, base string, practitionerRef string, practitioner Practitioner) (PractitionerDB, error) {
+	if !(len(practitioner.Name) > 0 && len(practitioner.Name[0].Given) > 0) {
+		slog.Warn("Practitioner inválido", "reference", practitionerRef)
+		return PractitionerDB{}, errInvalidReference
+	}
+	if practitioner.Name[0].Family == "" && cfg.PractitionerMissingFamily == "invalidate" {
+		slog.Warn("Practitioner sem sobrenome", "reference", practitionerRef)
+		return PractitionerDB{}, errInvalidReference
+	}
+
+	practitionerParsed := toPractitionerDB(practitioner)
+	if practitionerParsed.FamilyName == "" && cfg.PractitionerMissingFamily == "placeholder" {
+		practitionerParsed.FamilyName = cfg.FamilyNamePlaceholder
+	}
+	if cfg.ResolvePractitionerRole {
+		if specialty, ok := lookupPractitionerSpecialty(ctx, base, practitioner.ID); ok {
+			practitionerParsed.SpecialtyCode = specialty.Code
+			practitionerParsed.SpecialtyDisplay = specialty.Display
+		}
+	}
+	return practitionerParsed, nil
+}
+
+func resolvePatient(ctx context.Context, base string, patientRef string) (PatientDB, error) {
+	var patientParsed PatientDB
+	state, err := lookupCachedReference(ctx, patientRef, &patientParsed)
+	if err == nil && state == referenceCached {
+		return patientParsed, nil
+	}
+	if state == referenceAbsent {
+		slog.Debug("Paciente conhecido como ausente", "reference", patientRef)
+		return PatientDB{}, errReferenceAbsent
+	}
+
+	base, relative := splitReference(base, patientRef)
+	patientURL := withElements(fmt.Sprintf("%s/%s", base, relative), cfg.PatientElements)
+	slog.Debug("Buscando paciente", "url", patientURL)
+	patientData, err := fetchReferenceWithRetry(ctx, patientURL, cfg.FetchMaxRetries)
+	if err != nil {
+		slog.Error("Erro ao buscar paciente após retentativas", "attempts", cfg.FetchMaxRetries, "error", err)
+		markReferenceAbsentOnNotFound(ctx, patientRef, err)
+		return PatientDB{}, err
+	}
+
+	var patient Patient
+	if err := fastJSON.Unmarshal(patientData, &patient); err != nil {
+		slog.Error("Erro ao parsear JSON do paciente", "error", err)
+		return PatientDB{}, fmt.Errorf("%w: %v", errResponseParse, err)
+	}
+
+	if patient.ID != extractReferenceID(patientRef) {
+		slog.Warn("Paciente retornado com ID diferente da referência", "reference", patientRef, "id", patient.ID)
+		return PatientDB{}, errReferenceMismatch
+	}
+
+	if !(len(patient.Name) > 0 && len(patient.Name[0].Given) > 0) {
+		slog.Warn("Patient inválido", "reference", patientRef)
+		return PatientDB{}, errInvalidReference
+	}
+
+	patientParsed = toPatientDB(patient)
+	patientParsed.Gender = normalizeGender(ctx, patientParsed.Gender, patientRef)
+	storeCachedReference(ctx, patientRef, patientParsed)
+	return patientParsed, nil
+}
+
+// sqsClient is built once at startup when the sqs sink is enabled and shared
+// by every send, inline or from the SQS_SENDERS pool; the client is safe
+// for concurrent use.
+var sqsClient *sqs.Client
+
+func newSQSClient(ctx context.Context) (*sqs.Client, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(cfg.SQSRegion),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("test", "test", "")),
 		config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
 			func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 				return aws.Endpoint{
-					URL:           "http://localstack:4566",
-					SigningRegion: "sa-east-1",
+					URL:           cfg.SQSEndpoint,
+					SigningRegion: cfg.SQSRegion,
 				}, nil
 			},
 		)),
 	)
 
 	if err != nil {
-		return fmt.Errorf("error loading AWS config: %w", err)
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	return sqs.NewFromConfig(awsCfg), nil
+}
+
+// errSQSSendTimeout is returned when SendMessage or SendMessageBatch does not
+// complete within SQS_SEND_TIMEOUT; the encounter goes to invalid_encounters
+// like any other failed send.
+var errSQSSendTimeout = errors.New("SQS send timed out")
+
+// sqsEntry is a message ready for SQS: encoded, validated, compressed when
+// SQS_COMPRESSION is on, and within maxSQSMessageBytes.
+type sqsEntry struct {
+	body       []byte
+	attributes map[string]types.MessageAttributeValue
+}
+
+// size is what SQS counts against maxSQSMessageBytes, alone or in a batch.
+func (e sqsEntry) size() int {
+	return sqsMessageSize(e.body, e.attributes)
+}
+
+// prepareSQSMessage encodes message for SQS. The trace context of ctx
+// travels as message attributes so the worker can continue the trace.
+func prepareSQSMessage(ctx context.Context, message any, clientID string) (sqsEntry, error) {
+	msgBody, err := fastJSON.Marshal(message)
+	if err != nil {
+		return sqsEntry{}, fmt.Errorf("error converting message to JSON: %w", err)
+	}
+	// MESSAGE_SCHEMA describes data messages, not the date-complete marker.
+	if _, marker := message.(dateCompleteMessage); !marker {
+		if err := validateMessageBody(msgBody); err != nil {
+			return sqsEntry{}, err
+		}
 	}
 
-	sqsClient := sqs.NewFromConfig(cfg)
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	attributes := map[string]types.MessageAttributeValue{}
+	for key, value := range carrier {
+		attributes[key] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if cfg.SQSCompression {
+		rawSize := len(msgBody)
+		msgBody, err = compressBody(msgBody)
+		if err != nil {
+			return sqsEntry{}, err
+		}
+		attributes["contentEncoding"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(compressedEncoding)}
+		slog.Debug("Message compressed", "client", clientID, "rawBytes", rawSize, "compressedBytes", len(msgBody))
+	}
+	entry := sqsEntry{body: msgBody, attributes: attributes}
+	if size := entry.size(); size > maxSQSMessageBytes {
+		return sqsEntry{}, fmt.Errorf("%w: %d bytes, limit %d (compression enabled: %t)", errMessageOversized, size, maxSQSMessageBytes, cfg.SQSCompression)
+	}
+	return entry, nil
+}
+
+// startSQSSpan starts the producer span of one message.
+func startSQSSpan(ctx context.Context, fullUrl string, clientID string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "sendToSQS", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("messaging.system", "aws_sqs"),
+		attribute.String("messaging.destination.name", cfg.SQSQueueURL),
+		attribute.String("messaging.message.group_id", clientID),
+		attribute.String("full_url", fullUrl),
+	))
+}
 
-	queueURL := os.Getenv("SQS_QUEUE_URL")
-	if queueURL == "" {
-		log.Fatal("SQS_QUEUE_URL is empty.")
+// sqsSendContext bounds a SendMessage or SendMessageBatch call by
+// SQS_SEND_TIMEOUT.
+func sqsSendContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.SQSSendTimeout > 0 {
+		return context.WithTimeoutCause(ctx, cfg.SQSSendTimeout, errSQSSendTimeout)
 	}
+	return ctx, func() {}
+}
+
+// sqsCallError wraps the error of a SendMessage or SendMessageBatch call,
+// telling SQS_SEND_TIMEOUT apart from other failures.
+func sqsCallError(sendCtx context.Context, err error) error {
+	if errors.Is(context.Cause(sendCtx), errSQSSendTimeout) {
+		sqsSendTimeoutsTotal.Add(1)
+		return fmt.Errorf("%w after %s: %v", errSQSSendTimeout, cfg.SQSSendTimeout, err)
+	}
+	return fmt.Errorf("error sending message to SQS: %w", err)
+}
 
-	msgBody, err := json.Marshal(message)
+// sendToSQS sends one message body; fullUrl identifies the encounter it
+// belongs to in the trace and the sent journal. The sender pool batches
+// instead, through sendSQSBatch.
+func sendToSQS(ctx context.Context, message any, fullUrl string, clientID string) (err error) {
+	ctx, span := startSQSSpan(ctx, fullUrl, clientID)
+	defer func() { endSpan(span, err) }()
+
+	if sqsClient == nil {
+		return errors.New("SQS client not initialized")
+	}
+	entry, err := prepareSQSMessage(ctx, message, clientID)
 	if err != nil {
-		return fmt.Errorf("error converting message to JSON: %w", err)
+		return err
 	}
 
-	log.Printf("Sending message to SQS for client %s", clientID)
-	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
-		QueueUrl:       aws.String(queueURL),
-		MessageBody:    aws.String(string(msgBody)),
-		MessageGroupId: aws.String(clientID),
+	slog.Debug("Sending message to SQS", "client", clientID)
+	sendCtx, cancel := sqsSendContext(ctx)
+	defer cancel()
+	sendStart := time.Now()
+	output, err := sqsClient.SendMessage(sendCtx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(cfg.SQSQueueURL),
+		MessageBody:       aws.String(string(entry.body)),
+		MessageGroupId:    aws.String(clientID),
+		MessageAttributes: entry.attributes,
 	})
+	latency := time.Since(sendStart)
+	sqsSendsTotal.Add(1)
+	sqsSendLatencySeconds.Add(latency.Seconds())
+	span.SetAttributes(attribute.Float64("sqs.send_latency_ms", float64(latency.Microseconds())/1000))
 	if err != nil {
-		return fmt.Errorf("error sending message to SQS: %w", err)
+		return sqsCallError(sendCtx, err)
 	}
 
-	log.Printf("Message successfully sent to SQS for client %s", clientID)
+	recordSQSSent(ctx, entry, fullUrl, clientID, aws.ToString(output.MessageId))
+	slog.Debug("Message successfully sent to SQS", "client", clientID, "latency", latency)
 	return nil
 }
 
-func processDate(ctx context.Context, date string) error {
-	log.Printf("Processing date: %s", date)
-	url := fmt.Sprintf("https://hapi.fhir.org/baseR4/Encounter?date=%s", date)
+// recordSQSSent writes an accepted message to the sent journal.
+func recordSQSSent(ctx context.Context, entry sqsEntry, fullUrl string, clientID string, messageID string) {
+	journal.Record(ctx, journalEntry{
+		FullUrl:   fullUrl,
+		DedupID:   contentDedupID(entry.body),
+		MessageID: messageID,
+		ClientID:  clientID,
+		SentAt:    time.Now().UTC(),
+	})
+}
+
+// dateWindow is the span of days covered by one top-level search; it is a
+// single day unless BATCH_DAYS is greater than one.
+type dateWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (w dateWindow) Days() []string {
+	var days []string
+	for day := w.Start; !day.After(w.End); day = day.Add(24 * time.Hour) {
+		days = append(days, day.Format("2006-01-02"))
+	}
+	return days
+}
+
+func (w dateWindow) Label() string {
+	if w.Start.Equal(w.End) {
+		return w.Start.Format("2006-01-02")
+	}
+	return w.Start.Format("2006-01-02") + "_" + w.End.Format("2006-01-02")
+}
+
+func (w dateWindow) SearchURL() string {
+	if w.Start.Equal(w.End) {
+		return fmt.Sprintf("%s/Encounter?date=%s", activeFHIRBase(), w.Start.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%s/Encounter?date=ge%s&date=le%s", activeFHIRBase(), w.Start.Format("2006-01-02"), w.End.Format("2006-01-02"))
+}
+
+// QueryURL is the window's Encounter search with _sort and _elements applied.
+func (w dateWindow) QueryURL() string {
+	return encounterSearchURL(w.SearchURL())
+}
+
+// nextDateWindow starts a window of BATCH_DAYS days at start, clipped to endDate.
+func nextDateWindow(start time.Time, endDate time.Time) dateWindow {
+	window := dateWindow{Start: start, End: start.Add(time.Duration(cfg.BatchDays-1) * 24 * time.Hour)}
+	if window.End.After(endDate) {
+		window.End = endDate
+	}
+	return window
+}
+
+// processDate runs the window's search. A non-nil prefetch holding the
+// window's first page is used instead of fetching that page again.
+func processDate(ctx context.Context, window dateWindow, prefetch *pagePrefetch) (err error) {
+	date := window.Label()
+	ctx, span := tracer.Start(ctx, "processDate", trace.WithAttributes(attribute.String("date", date)))
+	defer func() { endSpan(span, err) }()
+
+	slog.Info("Processing date", "date", date)
+	processingDate.Set(date)
+	ctx, endWatch := watchdog.Begin(ctx, date)
+	defer endWatch()
+	url := window.QueryURL()
 
-	const maxRetries = 3
-	data, err := fetchDataWithRetry(ctx, url, maxRetries)
+	var out *ndjsonWriter
+	if ndjsonSinkEnabled {
+		out, err = openNDJSONWriter(date)
+		if err != nil {
+			return fmt.Errorf("falha ao abrir arquivo NDJSON da data %s: %w", date, err)
+		}
+	}
+
+	defer setAttributionWindow(window)()
+	batch, endBatch := startPatientBatch(window)
+	defer endBatch()
+
+	var sentBefore int
+	stats.update(func(s *runStats) { sentBefore = s.EncountersSent })
+	result, err := processEncounterSearch(ctx, url, out, prefetch, func(entries []BundleEntry) error {
+		return checkDateWindow(window, entries)
+	})
+	// A failed window is retried as a whole, so its partial groups are
+	// dropped rather than sent.
+	if batch != nil && err == nil {
+		batch.Flush(ctx, out)
+	}
+	if out != nil {
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("falha ao finalizar arquivo NDJSON da data %s: %w", date, closeErr)
+		}
+	}
+	span.SetAttributes(attribute.Int("total", result.Total), attribute.Int("entries", result.Entries), attribute.Int("pages", result.Pages), attribute.Bool("truncated", result.Truncated))
 	if err != nil {
-		log.Printf("Add failed date to unprocessed_dates: %v", date, err)
-		_, redisErr := redisClient.SAdd(ctx, "unprocessed_dates", date).Result()
-		if redisErr != nil {
-			log.Printf("Erro ao adicionar data não processada no Redis: %v", redisErr)
+		if cause := context.Cause(ctx); errors.Is(cause, errDateStalled) {
+			err = cause
 		}
+		emitErrorEvent(ctx, failurePhase(err), url, "", err)
 		return fmt.Errorf("falha ao processar data %s: %w", date, err)
 	}
 
-	var bundle Bundle
-	if err := json.Unmarshal(data, &bundle); err != nil {
-		return fmt.Errorf("erro ao parsear JSON de encontros: %w", err)
+	if result.Truncated {
+		if err := state.AddToSet(ctx, "partial_dates", window.Days()...); err != nil {
+			slog.Error("Error adding to partial_dates", "error", err)
+		}
 	}
 
-	if len(bundle.Entry) == 0 {
-		log.Printf("Nenhum encontro encontrado para a data: %s", date)
-		return nil
+	if result.Entries == 0 {
+		slog.Info("Nenhum encontro encontrado para a data", "date", date)
+		emptyDatesTotal.Add(int64(len(window.Days())))
+		if cfg.StrictEmptyDates && lastDateEntryCount >= cfg.EmptyDateThreshold {
+			slog.Warn("Date returned no encounters but the previous date did, check the query", "date", date, "previousCount", lastDateEntryCount)
+		}
+		if err := state.AddToSet(ctx, "empty_dates", window.Days()...); err != nil {
+			slog.Error("Error adding to empty_dates", "error", err)
+		}
 	}
+	lastDateEntryCount = result.Entries
 
+	// Dates run one at a time, so the run's sent count moved only for this
+	// window.
+	var sent int
+	stats.update(func(s *runStats) { sent = s.EncountersSent - sentBefore })
+	sendDateComplete(ctx, window, result, sent)
+	return nil
+}
+
+func stringsToAny(values []string) []interface{} {
+	members := make([]interface{}, len(values))
+	for i, value := range values {
+		members[i] = value
+	}
+	return members
+}
+
+type searchResult struct {
+	Total     int
+	Entries   int
+	Pages     int
+	Truncated bool
+}
+
+// processEncounterSearch runs an Encounter search, paging through the results
+// up to MAX_PAGES, and processes every entry. A prefetch is used for the
+// first page when its URL matches; a failed prefetch falls back to fetching.
+// When checkFirstPage is set, the first page's entries are held back until
+// it approves them. With RESUME_PAGINATION the search restarts from its last
+// checkpoint, skipping encounters already sent.
+func processEncounterSearch(ctx context.Context, searchURL string, out *ndjsonWriter, prefetch *pagePrefetch, checkFirstPage func([]BundleEntry) error) (searchResult, error) {
 	var wg sync.WaitGroup
-	for i, entry := range bundle.Entry {
-		wg.Add(1)
-		clientID := "001"
-		if i%2 == 1 {
-			clientID = "002"
+	defer wg.Wait()
+
+	var result searchResult
+	// Non-conformant servers sometimes repeat a fullUrl within a page or
+	// across pages; each one is processed once per search. Sized for a page
+	// until Bundle.total tells the whole search's size.
+	seen := make(map[string]bool, cfg.PageSize)
+	pager := newPager(searchURL)
+	pageURL := pager.FirstPage()
+
+	var resume *searchResume
+	resumedPage := false
+	if cfg.ResumePagination {
+		resume = newSearchResume(searchURL)
+		if checkpoint, ok := resume.Load(ctx); ok {
+			slog.Info("Resuming search from checkpoint", "url", searchURL, "page", checkpoint.Pages+1, "processed", checkpoint.Entries)
+			pageURL = checkpoint.URL
+			pager.strategy, pager.offset = checkpoint.Strategy, checkpoint.Offset
+			result = searchResult{Pages: checkpoint.Pages, Entries: checkpoint.Entries, Total: checkpoint.Total}
+			seen = make(map[string]bool, searchCapacity(result.Total))
+			resumedPage = true
 		}
+	}
+	// A page's encounters may still be in flight while the next one is
+	// dispatched, so the checkpoint only moves past a page once it is done.
+	var previousPage *sync.WaitGroup
 
-		go func(enc Encounter, fullUrl string, clientID string) {
-			defer wg.Done()
-			processEncounter(ctx, enc, fullUrl, clientID)
-		}(entry.Resource, entry.FullUrl, clientID)
+	for pageURL != "" {
+		if cfg.MaxPages > 0 && result.Pages >= cfg.MaxPages {
+			slog.Warn("MAX_PAGES reached, not fetching further pages", "url", searchURL, "pages", result.Pages)
+			result.Truncated = true
+			break
+		}
+
+		var held []BundleEntry
+		pageWG := &sync.WaitGroup{}
+		entriesBefore := result.Entries
+		process := func(entry BundleEntry) {
+			if cfg.SkipDuplicateEntries && entry.FullUrl != "" {
+				if seen[entry.FullUrl] {
+					slog.Warn("Duplicate fullUrl in search results, skipping", "fullUrl", entry.FullUrl, "page", result.Pages+1)
+					stats.update(func(s *runStats) { s.DuplicateEntries++ })
+					return
+				}
+				seen[entry.FullUrl] = true
+			}
+			if resume != nil && resume.AlreadySent(ctx, entry.FullUrl) {
+				slog.Debug("Encounter already sent before the restart, skipping", "fullUrl", entry.FullUrl)
+				result.Entries++
+				return
+			}
+			wg.Add(1)
+			pageWG.Add(1)
+			result.Entries++
+			stats.update(func(s *runStats) { s.EncountersSeen++ })
+
+			go func(enc Encounter, base string, fullUrl string) {
+				defer wg.Done()
+				defer pageWG.Done()
+				defer watchdog.Progress()
+				if processEncounter(ctx, enc, base, fullUrl, out) && resume != nil {
+					resume.MarkSent(ctx, fullUrl)
+				}
+			}(entry.Resource, entry.Base, entry.FullUrl)
+		}
+		dispatch := process
+		if checkFirstPage != nil && result.Pages == 0 {
+			held = make([]BundleEntry, 0, cfg.PageSize)
+			dispatch = func(entry BundleEntry) { held = append(held, entry) }
+		}
+
+		var page bundlePage
+		var err error
+		if prefetch != nil && prefetch.URL == pageURL {
+			data, base, prefetchErr := prefetch.Wait()
+			prefetch = nil
+			if prefetchErr == nil {
+				page, err = dispatchBundle(data, base, dispatch)
+			} else {
+				slog.Warn("Prefetch failed, fetching page again", "url", pageURL, "error", prefetchErr)
+				page, err = fetchBundlePage(ctx, pageURL, cfg.FetchMaxRetries, dispatch)
+			}
+		} else {
+			page, err = fetchBundlePage(ctx, pageURL, cfg.FetchMaxRetries, dispatch)
+		}
+		if err != nil && resumedPage && isExpiredPageLink(err) {
+			// Servers expire paging links; start over, still skipping what
+			// was sent before the restart.
+			slog.Warn("Checkpointed page is no longer available, restarting search from the first page", "url", pageURL, "error", err)
+			pager = newPager(searchURL)
+			pageURL = pager.FirstPage()
+			result = searchResult{}
+			resumedPage = false
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if result.Pages == 0 {
+			result.Total = page.Total
+			if capacity := searchCapacity(result.Total); capacity > len(seen) {
+				grown := make(map[string]bool, capacity)
+				maps.Copy(grown, seen)
+				seen = grown
+			}
+		}
+		if checkFirstPage != nil && result.Pages == 0 {
+			if err := checkFirstPage(held); err != nil {
+				return result, err
+			}
+			for _, entry := range held {
+				process(entry)
+			}
+		}
+		if resume != nil {
+			if previousPage != nil {
+				previousPage.Wait()
+			}
+			resume.Save(ctx, searchCheckpoint{
+				URL:      pageURL,
+				Strategy: pager.strategy,
+				Offset:   pager.offset,
+				Pages:    result.Pages,
+				Entries:  entriesBefore,
+				Total:    result.Total,
+			})
+			previousPage = pageWG
+		}
+		resumedPage = false
+		result.Pages++
+		if result.Total > 0 {
+			slog.Info("Search progress", "url", searchURL, "page", result.Pages, "processed", result.Entries, "total", result.Total)
+		}
+
+		pageURL = pager.NextPage(page)
 	}
 
-	wg.Wait()
-	return nil
+	if resume != nil {
+		wg.Wait()
+		resume.Clear(ctx)
+	}
+
+	// Bundle.total counts every match, so fewer entries after following all
+	// pages means a page was lost or the result set changed while paging.
+	if !result.Truncated && result.Entries < result.Total {
+		slog.Warn("Search returned fewer entries than Bundle.total, pages may have been missed", "url", searchURL, "entries", result.Entries, "total", result.Total)
+	}
+	return result, nil
+}
+
+// searchCapacity is how many entries to allocate for a search of total
+// matches, bounded by MAX_PAGES so a huge total does not allocate for pages
+// that will never be fetched.
+func searchCapacity(total int) int {
+	if cfg.MaxPages > 0 {
+		return min(total, cfg.MaxPages*cfg.PageSize)
+	}
+	return total
+}
+
+// fetchBundlePage fetches one search page and hands each entry to dispatch.
+// The returned page carries the links and entry count but not the entries.
+func fetchBundlePage(ctx context.Context, pageURL string, maxRetries int, dispatch func(BundleEntry)) (bundlePage, error) {
+	if cfg.StreamingParse {
+		return streamBundlePage(ctx, pageURL, maxRetries, dispatch)
+	}
+
+	data, base, err := retryFetchFailover(ctx, pageURL, maxRetries, fetchData)
+	if err != nil {
+		return bundlePage{}, err
+	}
+	return dispatchBundle(data, base, dispatch)
+}
+
+// dispatchBundle hands each entry of a page returned by base to dispatch.
+// An empty base, for a page under no configured server, resolves references
+// against the active server.
+func dispatchBundle(data []byte, base string, dispatch func(BundleEntry)) (bundlePage, error) {
+	var bundle Bundle
+	if err := fastJSON.Unmarshal(data, &bundle); err != nil {
+		return bundlePage{}, fmt.Errorf("erro ao parsear JSON de encontros: %w: %v", errResponseParse, err)
+	}
+
+	if base == "" {
+		base = activeFHIRBase()
+	}
+	if err := checkBundleType(bundle.Type, base); err != nil {
+		return bundlePage{}, err
+	}
+	page := bundlePage{Next: bundle.NextLink(), Total: bundle.Total}
+	for _, entry := range bundle.Entry {
+		if !entry.IsEncounter() {
+			slog.Debug("Skipping non-Encounter Bundle entry", "fullUrl", entry.FullUrl, "resourceType", entry.ResourceType)
+			continue
+		}
+		page.Entries++
+		entry.Base = base
+		dispatch(entry)
+	}
+	return page, nil
 }
 
+// fetchDataWithRetry fetches url, failing over to the next FHIR server when
+// the one it belongs to keeps failing.
 func fetchDataWithRetry(ctx context.Context, url string, maxRetries int) ([]byte, error) {
+	data, _, err := retryFetchFailover(ctx, url, maxRetries, fetchData)
+	return data, err
+}
+
+// retryFetch calls fetch up to maxRetries times with exponential backoff.
+// Cancelling ctx interrupts the backoff at once and returns the context error
+// rather than the "All attempts were failed" one.
+func retryFetch[T any](ctx context.Context, url string, maxRetries int, fetch func(ctx context.Context) (T, error)) (T, error) {
+	ctx, span := tracer.Start(ctx, "fetchData", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("url.full", url)))
+	defer span.End()
+
+	var lastErr error
 	for i := 0; i < maxRetries; i++ {
 		if i > 0 {
 			waitTime := time.Second * time.Duration(1<<uint(i))
-			log.Printf("Re-trying %d/%d in %v...", i, maxRetries, waitTime)
-			time.Sleep(waitTime)
+			slog.Debug("Re-trying request", "attempt", i, "maxRetries", maxRetries, "wait", waitTime)
+			select {
+			case <-ctx.Done():
+				var zero T
+				err := fmt.Errorf("retry cancelled after %d attempts: %w (last error: %v)", i, ctx.Err(), lastErr)
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return zero, err
+			case <-time.After(waitTime):
+			}
 		}
+		span.SetAttributes(attribute.Int("retry_count", i))
 
-		data, err := fetchData(ctx, url)
+		data, err := fetch(ctx)
 		if err == nil {
 			return data, nil
 		}
+		lastErr = err
+		span.AddEvent("attempt failed", trace.WithAttributes(attribute.Int("attempt", i+1), attribute.String("error", err.Error())))
 
-		log.Printf("Attempt %d/%d failed to request %s: %v", i+1, maxRetries, url, err)
+		slog.Warn("Request attempt failed", "attempt", i+1, "maxRetries", maxRetries, "url", url, "error", err)
 	}
-	return nil, fmt.Errorf("All attempts were failed")
+	var zero T
+	err := fmt.Errorf("All attempts were failed: %w", lastErr)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return zero, err
 }
 
+// initLogger writes logs to stderr, and to rotated files unless
+// LOG_STDOUT_ONLY, keeping stdout for the run summary and MODE=single output.
 func initLogger() {
-	writer, err := rotatelogs.New(
-		"/app/logs/logs/collector.%Y-%m-%d.log",
-		rotatelogs.WithLinkName("/app/logs/collector.log"),
-		rotatelogs.WithRotationTime(24*time.Hour),
-		rotatelogs.WithMaxAge(72*time.Hour),
-	)
+	level := parseLogLevel(cfg.LogLevel)
+	consoleLogger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if cfg.LogStdoutOnly {
+		slog.SetDefault(consoleLogger)
+		return
+	}
+
+	filePattern := filepath.Join(cfg.LogDir, cfg.LogFilePattern)
+
+	writer, err := newRotatingWriter(filePattern, filepath.Join(cfg.LogDir, "collector.log"))
 	if err != nil {
-		log.Fatalf("Erro ao configurar rotação de logs: %v", err)
+		slog.SetDefault(consoleLogger)
+		slog.Warn("Erro ao configurar rotação de logs, usando apenas stderr", "error", err)
+		return
 	}
-	multi := io.MultiWriter(os.Stdout, writer)
-	log.SetOutput(multi)
+
+	multi := io.MultiWriter(os.Stderr, writer)
+	handler := slog.NewTextHandler(multi, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(handler))
 }
 
-func initCache() {
-	valkeyUri := os.Getenv("VALKEY_URI")
-	// valkeyPwd := os.Getenv("VALKEY_PWD")
+func newRotatingWriter(filePattern string, linkName string) (io.Writer, error) {
+	if err := os.MkdirAll(filepath.Dir(filePattern), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating log dir: %w", err)
+	}
+
+	options := []rotatelogs.Option{
+		rotatelogs.WithLinkName(linkName),
+		rotatelogs.WithRotationTime(cfg.LogRotationTime),
+		rotatelogs.WithMaxAge(cfg.LogMaxAge),
+	}
+	if cfg.LogMaxSizeMB > 0 {
+		options = append(options, rotatelogs.WithRotationSize(int64(cfg.LogMaxSizeMB)*1024*1024))
+	}
+
+	return rotatelogs.New(filePattern, options...)
+}
+
+func parseLogLevel(value string) slog.Level {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug
+	case "", "info":
+		return slog.LevelInfo
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
 
+// initCache creates the Redis client. REDIS_POOL_SIZE caps its connections
+// (0 keeps the client default of 10 per CPU) and a command that waits more
+// than REDIS_POOL_TIMEOUT for a free one fails instead of hanging.
+func initCache() {
 	redisClient = redis.NewClient(&redis.Options{
-		Addr: valkeyUri,
-		// Password: valkeyPwd,
-		DB: 0,
+		Addr:        cfg.ValkeyURI,
+		Password:    cfg.ValkeyPassword,
+		DB:          0,
+		PoolSize:    cfg.RedisPoolSize,
+		PoolTimeout: cfg.RedisPoolTimeout,
 	})
 
+	poolSize := redisClient.Options().PoolSize
+	slog.Debug("Redis connection pool", "size", poolSize, "timeout", cfg.RedisPoolTimeout)
+	if cfg.ReferenceFetchConcurrency > poolSize || cfg.SQSSenders > poolSize {
+		slog.Warn("REDIS_POOL_SIZE is below the worker concurrency, workers will wait for Redis connections",
+			"poolSize", poolSize, "referenceFetchConcurrency", cfg.ReferenceFetchConcurrency, "sqsSenders", cfg.SQSSenders)
+	}
+	expvar.Publish("redis_pool", expvar.Func(func() any { return redisClient.PoolStats() }))
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML or JSON configuration file")
+	encounterURL := flag.String("url", "", "fullUrl of the encounter to reprocess with MODE=single")
+	send := flag.Bool("send", false, "with MODE=single, send the message to SINKS instead of printing it")
+	flag.Parse()
+	if err := singleModeFlags(*encounterURL, *send); err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
+	var err error
+	cfg, err = loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	if cfg.Mode == "single" {
+		// The point of MODE=single is seeing every step of one encounter.
+		cfg.LogLevel = "debug"
+	}
 	initLogger()
+	logEffectiveConfig(cfg)
+	// Registered first so it runs after every other deferred cleanup.
+	defer func() {
+		if processExitCode != 0 {
+			os.Exit(processExitCode)
+		}
+	}()
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		slog.Error("Error initializing tracing, continuing without it", "error", err)
+	}
+	defer shutdownTracing(ctx)
 	initCache()
-	startDateStr := os.Getenv("START_DATE")
-	endDateStr := os.Getenv("END_DATE")
+	initStateStore()
+	initFHIRServers()
+	initHTTPClient()
+	initJSONCodec()
+	initMetrics()
+	stopHeartbeat := startHeartbeat(cfg.HeartbeatInterval)
+	defer stopHeartbeat()
+	stopWatchdog := startWatchdog(cfg.StallTimeout)
+	defer stopWatchdog()
+	// MODE=preflight reports certificates as one of its checks.
+	if cfg.CertExpiryWarning > 0 && cfg.Mode != "preflight" {
+		checkCertExpiry(ctx)
+	}
+	if cfg.IncludeSource && cfg.Mode != "preflight" {
+		loadServerSources(ctx)
+	}
 
-	if startDateStr == "" || endDateStr == "" {
-		log.Fatal("START_DATE and END_DATE environment variables are required")
+	statusMapping, _ = parseStatusMapping(cfg.StatusMapping)
+	if cfg.PeriodTimezone != "" {
+		periodLocation, _ = time.LoadLocation(cfg.PeriodTimezone)
 	}
+	organizationClients, _ = parseOrganizationClients(cfg.OrganizationClients)
+	if cfg.ReferenceFetchConcurrency > 0 {
+		referenceFetchSlots = make(chan struct{}, cfg.ReferenceFetchConcurrency)
+	}
+	outputTemplate, err = loadOutputTemplate(cfg.OutputTemplate)
+	if err != nil {
+		log.Fatalf("Invalid output template: %v", err)
+	}
+	messageSchema, err = loadMessageSchema(cfg.MessageSchema)
+	if err != nil {
+		log.Fatalf("Invalid message schema: %v", err)
+	}
+	initRunID()
+	sqsSinkEnabled = cfg.SinkEnabled("sqs")
+	if sqsSinkEnabled {
+		sqsClient, err = newSQSClient(ctx)
+		if err != nil {
+			log.Fatalf("Error creating SQS client: %v", err)
+		}
+		startSQSSenders(cfg.SQSSenders)
+	}
+	ndjsonSinkEnabled = cfg.SinkEnabled("ndjson")
+
+	defer redisClient.Close()
 
-	startDate, err := time.Parse("2006-01-02", startDateStr)
+	journal, err = openJournal()
 	if err != nil {
-		log.Fatalf("Invalid START_DATE format: %v", err)
+		log.Fatalf("Error opening sent message journal: %v", err)
 	}
+	defer journal.Close()
 
-	endDate, err := time.Parse("2006-01-02", endDateStr)
+	errorEvents, err = openErrorEvents()
 	if err != nil {
-		log.Fatalf("Invalid END_DATE format: %v", err)
+		log.Fatalf("Error opening error events: %v", err)
+	}
+	defer errorEvents.Close()
+
+	// MODE=single never touches the cursor, so it may run alongside a
+	// normal run.
+	// READONLY takes no lock either: it never moves the cursor.
+	if cfg.RunLock && cfg.Mode != "preflight" && cfg.Mode != "single" && !suppressWrite("set nx", cfg.LockKey) {
+		lock, err := acquireRunLock(ctx)
+		if err != nil {
+			log.Fatalf("Error acquiring run lock: %v", err)
+		}
+		defer lock.Release(ctx)
 	}
 
-	log.Printf("Checking previous date processed in cache")
-	lastProcessedDateStr, err := redisClient.Get(ctx, "last_processed_date").Result()
-	if err != nil && err != redis.Nil {
-		log.Fatalf("Error getting last processed date from Redis: %v", err)
+	runDeadline = loadRunDeadline(time.Now())
+
+	if cfg.Mode != "preflight" {
+		verifyCapabilities(ctx)
+	}
+
+	if cfg.WarmUpPractitioners && cfg.Mode != "preflight" && cfg.Mode != "single" {
+		warmUpPractitioners(ctx)
 	}
 
+	// FAIL_FAST cancels runCtx; ctx stays usable for the deferred cleanup.
+	runCtx := withRunCancel(ctx)
+
+	var currentDate, limit time.Time
+	switch cfg.Mode {
+	case "backfill":
+		currentDate, limit = backfillRange(ctx)
+	case "catchup":
+		currentDate, limit = catchupRange(ctx)
+	case "patients":
+		runPatients(runCtx)
+		finishRun()
+		return
+	case "preflight":
+		if !runPreflight(ctx) {
+			os.Exit(1)
+		}
+		return
+	case "single":
+		runSingle(runCtx)
+		return
+	case "continuous":
+		runContinuous(runCtx)
+		finishRun()
+		return
+	}
+
+	runDateRange(runCtx, currentDate, limit, processDate)
+	runLookback(runCtx)
+	finishRun()
+}
+
+// loadRunDeadline combines MAX_RUNTIME (relative to start) and RUN_DEADLINE
+// (RFC3339), keeping whichever comes first. A zero time means no deadline.
+func loadRunDeadline(start time.Time) time.Time {
+	var deadline time.Time
+	if cfg.MaxRuntime > 0 {
+		deadline = start.Add(cfg.MaxRuntime)
+	}
+	if cfg.RunDeadline != "" {
+		absolute, _ := time.Parse(time.RFC3339, cfg.RunDeadline)
+		if deadline.IsZero() || absolute.Before(deadline) {
+			deadline = absolute
+		}
+	}
+	return deadline
+}
+
+func deadlineReached() bool {
+	return !runDeadline.IsZero() && time.Now().After(runDeadline)
+}
+
+// backfillRange returns where the backfill starts and the date it stops at:
+// START_DATE to END_DATE, or END_DATE back to START_DATE with DIRECTION=desc,
+// resuming from the stored cursor.
+func backfillRange(ctx context.Context) (time.Time, time.Time) {
+	startDate, _ := time.Parse("2006-01-02", cfg.StartDate)
+	endDate, _ := time.Parse("2006-01-02", cfg.EndDate)
+
+	if cfg.Direction == "desc" {
+		oldestProcessedDate, found := loadCursorDate(ctx, "oldest_processed_date")
+		if !found {
+			slog.Info("No oldest processed date found, starting from END_DATE", "date", cfg.EndDate)
+			return endDate, startDate
+		}
+		slog.Info("Resuming backwards from oldest processed date", "date", oldestProcessedDate.Format("2006-01-02"))
+		return oldestProcessedDate, startDate
+	}
+
+	lastProcessedDate, found := loadLastProcessedDate(ctx)
+
 	var currentDate time.Time
-	if lastProcessedDateStr == "" {
+	if !found {
 		currentDate = startDate
-		log.Printf("No last processed date found, starting from START_DATE: %s", startDateStr)
+		slog.Info("No last processed date found, starting from START_DATE", "date", cfg.StartDate)
 	} else {
-		currentDate, err = time.Parse("2006-01-02", lastProcessedDateStr)
-		if err != nil {
-			log.Fatalf("Invalid last processed date format in cache: %v", err)
-		}
-		log.Printf("Resuming from last processed date: %s", lastProcessedDateStr)
+		currentDate = lastProcessedDate
+		slog.Info("Resuming from last processed date", "date", lastProcessedDate.Format("2006-01-02"))
+	}
+	slog.Debug("Current date", "date", currentDate)
+
+	return currentDate, endDate
+}
+
+// catchupRange processes from the day after the stored cursor through
+// yesterday, falling back to CATCHUP_LOOKBACK_DAYS when there is no cursor.
+func catchupRange(ctx context.Context) (time.Time, time.Time) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	endDate := today.Add(-24 * time.Hour)
+
+	lastProcessedDate, found := loadLastProcessedDate(ctx)
+	if found {
+		currentDate := lastProcessedDate.Add(24 * time.Hour)
+		slog.Info("Catching up from last processed date", "from", currentDate.Format("2006-01-02"), "to", endDate.Format("2006-01-02"))
+		return currentDate, endDate
 	}
-	log.Printf("**** currentDate **** %v", currentDate)
+
+	currentDate := today.Add(-time.Duration(cfg.CatchupLookbackDays) * 24 * time.Hour)
+	slog.Info("No last processed date found, catching up from lookback", "from", currentDate.Format("2006-01-02"), "to", endDate.Format("2006-01-02"))
+	return currentDate, endDate
+}
+
+func loadLastProcessedDate(ctx context.Context) (time.Time, bool) {
+	return loadCursorDate(ctx, "last_processed_date")
+}
+
+func loadCursorDate(ctx context.Context, name string) (time.Time, bool) {
+	slog.Info("Checking previous date processed in cache", "cursor", name)
+	value, err := state.GetCursor(ctx, name)
+	if err != nil {
+		log.Fatalf("Error getting %s: %v", name, err)
+	}
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		log.Fatalf("Invalid %s format in cache: %v", name, err)
+	}
+	return date, true
+}
+
+// dateProcessor runs the search of one date window; processDate in a run.
+type dateProcessor func(ctx context.Context, window dateWindow, prefetch *pagePrefetch) error
+
+// runDateRange processes dates from currentDate to limit, which is the end
+// date, or the start date when walking backwards with DIRECTION=desc, with
+// process running each window.
+func runDateRange(ctx context.Context, currentDate time.Time, limit time.Time, process dateProcessor) {
+	maxDateAttempts := cfg.MaxDateAttempts
+	dateAttempts := 0
+	consecutiveFailures := 0
+	walk := newDateWalk(limit)
+
+	cursor := newCursorCommitter(walk.cursorName(), cfg.CursorCommitEvery, cfg.CursorCommitInterval)
+	defer cursor.Flush(context.WithoutCancel(ctx))
+
+	var prefetched *pagePrefetch
 
 	for {
-		if currentDate.After(endDate) {
-			log.Printf("Reached END_DATE (%s), stopping processing", endDateStr)
-			log.Println("Processing completed")
+		if walk.done(currentDate) {
+			slog.Info("Reached "+walk.limitName()+", stopping processing", "date", limit.Format("2006-01-02"))
+			slog.Info("Processing completed")
+			break
+
+		} else if deadlineReached() {
+			slog.Warn("Run deadline reached, stopping before next date", "nextDate", currentDate.Format("2006-01-02"), "deadline", runDeadline)
 			break
 
 		} else {
-			dateStr := currentDate.Format("2006-01-02")
-			err := processDate(ctx, dateStr)
+			window := walk.window(currentDate)
+			dateStr := window.Label()
+
+			var current *pagePrefetch
+			if prefetched != nil && prefetched.URL == window.firstPageURL() {
+				current, prefetched = prefetched, nil
+			}
+			// The next window's first page is fetched while this one is
+			// processed; a retry of this window keeps the same prefetch.
+			nextStart := walk.next(window)
+			if cfg.PrefetchNextDate && prefetched == nil && !walk.done(nextStart) {
+				prefetched = prefetchPage(ctx, walk.window(nextStart).firstPageURL())
+			}
+
+			err := process(ctx, window, current)
+			if errors.Is(err, errDateParameterIgnored) {
+				slog.Error("Aborting run, every date would pull encounters outside its range", "date", dateStr, "error", err)
+				// Aborted with or without FAIL_FAST, so the run exits non-zero
+				// and skips the lookback.
+				abortRun(err)
+				break
+			}
+			// Under FAIL_FAST the date is neither retried nor skipped, so the
+			// cursor stays on it for the next run.
+			if abortOnFatal(err) {
+				break
+			}
 			if err != nil {
-				log.Printf("Error processing date %s: %v", dateStr, err)
-			} else {
-				_, err := redisClient.Set(ctx, "last_processed_date", dateStr, 0).Result()
-				if err != nil {
-					log.Printf("Error updating last processed date in Redis: %v", err)
+				dateAttempts++
+				slog.Error("Error processing date", "date", dateStr, "attempt", dateAttempts, "maxAttempts", maxDateAttempts, "error", err)
+				if dateAttempts < maxDateAttempts {
+					coolDownAfterDateFailure(ctx, dateStr, consecutiveFailures, true)
+					continue
 				}
-				currentDate = currentDate.Add(24 * time.Hour)
+				if cfg.FailFast {
+					abortRun(fmt.Errorf("data %s falhou após %d tentativas: %w", dateStr, dateAttempts, err))
+					break
+				}
+				slog.Warn("Giving up on date, adding to unprocessed_dates", "date", dateStr)
+				stats.update(func(s *runStats) { s.DatesFailed += len(window.Days()) })
+				if err := state.AddToSet(ctx, "unprocessed_dates", window.Days()...); err != nil {
+					slog.Error("Erro ao adicionar data não processada", "error", err)
+				}
+				consecutiveFailures++
+			} else {
+				stats.update(func(s *runStats) { s.DatesProcessed += len(window.Days()) })
+				consecutiveFailures = 0
+			}
+
+			for _, day := range walk.days(window) {
+				cursor.Advance(ctx, day)
+			}
+			dateAttempts = 0
+			currentDate = walk.next(window)
+			if consecutiveFailures > 0 && !walk.done(currentDate) {
+				coolDownAfterDateFailure(ctx, dateStr, consecutiveFailures, false)
 			}
 		}
 	}
-	defer redisClient.Close()
-	log.Println("Finish!")
 }
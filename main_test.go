@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParsePractitionerMissingFamily(t *testing.T) {
+	var practitioner Practitioner
+	if err := json.Unmarshal([]byte(`{"resourceType": "Practitioner", "id": "2000", "name": [{"given": ["Ana"]}]}`), &practitioner); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy     string
+		wantErr    error
+		wantFamily string
+	}{
+		{policy: "allow", wantFamily: ""},
+		{policy: "invalidate", wantErr: errInvalidReference},
+		{policy: "placeholder", wantFamily: "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.PractitionerMissingFamily = tt.policy
+				c.FamilyNamePlaceholder = "-"
+				c.ResolvePractitionerRole = false
+			})
+			parsed, err := parsePractitioner(context.Background(), "http://fhir", "Practitioner/2000", practitioner)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if parsed.GivenName != "Ana" || parsed.FamilyName != tt.wantFamily {
+				t.Fatalf("name = %q %q, want %q %q", parsed.GivenName, parsed.FamilyName, "Ana", tt.wantFamily)
+			}
+		})
+	}
+}
+
+func TestEncounterSearchURLSort(t *testing.T) {
+	const search = "http://fhir/Encounter?date=2024-01-15&status=finished"
+	tests := []struct {
+		name string
+		sort string
+		want string
+	}{
+		{name: "default", sort: defaultConfig().SearchSort, want: search + "&_sort=_lastUpdated"},
+		{name: "empty", sort: "", want: search},
+		{name: "none", sort: "none", want: search},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.SearchSort = tt.sort
+				c.EncounterSummary = ""
+				c.EncounterElements = ""
+			})
+			if got := encounterSearchURL(search); got != tt.want {
+				t.Fatalf("encounterSearchURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("without query string", func(t *testing.T) {
+		setConfig(t, func(c *Config) {
+			c.SearchSort = "_lastUpdated"
+			c.EncounterSummary = ""
+			c.EncounterElements = ""
+		})
+		if got, want := encounterSearchURL("http://fhir/Encounter"), "http://fhir/Encounter?_sort=_lastUpdated"; got != want {
+			t.Fatalf("encounterSearchURL = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestPractitionerRoleURLEscapesID(t *testing.T) {
+	const want = "http://fhir/PractitionerRole?practitioner=abc%26_count%3D1000"
+	if got := practitionerRoleURL("http://fhir", "abc&_count=1000"); got != want {
+		t.Fatalf("practitionerRoleURL = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// maxSQSMessageBytes is the SQS limit on a message, counting the body and
+// every message attribute.
+const maxSQSMessageBytes = 256 * 1024
+
+// errMessageOversized is returned, without calling SQS, for a message over
+// maxSQSMessageBytes after SQS_COMPRESSION; the encounter goes to the
+// oversized_messages set instead of invalid_encounters.
+var errMessageOversized = errors.New("message exceeds the SQS size limit")
+
+// compressedEncoding is the value of the contentEncoding message attribute
+// on bodies compressed by SQS_COMPRESSION. Consumers base64-decode the body
+// and then gunzip it; a message without the attribute is plain JSON.
+const compressedEncoding = "gzip+base64"
+
+// compressBody gzips body and base64-encodes the result, since an SQS body
+// must be text.
+func compressBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("error compressing message: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing message: %w", err)
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(buf.Len()))
+	base64.StdEncoding.Encode(encoded, buf.Bytes())
+	return encoded, nil
+}
+
+// sqsMessageSize is the size SQS counts against maxSQSMessageBytes: the body
+// plus each attribute's name, data type and value.
+func sqsMessageSize(body []byte, attributes map[string]types.MessageAttributeValue) int {
+	size := len(body)
+	for name, value := range attributes {
+		size += len(name) + len(aws.ToString(value.DataType)) + len(aws.ToString(value.StringValue)) + len(value.BinaryValue)
+	}
+	return size
+}
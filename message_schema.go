@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// messageSchema, loaded from MESSAGE_SCHEMA, is checked against every body
+// before it is sent to SQS; nil disables the check.
+var messageSchema *jsonschema.Schema
+
+var errSchemaInvalid = errors.New("message does not match MESSAGE_SCHEMA")
+
+func loadMessageSchema(path string) (*jsonschema.Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading MESSAGE_SCHEMA: %w", err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(path, bytes.NewReader(text)); err != nil {
+		return nil, fmt.Errorf("error parsing MESSAGE_SCHEMA: %w", err)
+	}
+	schema, err := compiler.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling MESSAGE_SCHEMA: %w", err)
+	}
+	return schema, nil
+}
+
+// validateMessageBody checks a serialized message against MESSAGE_SCHEMA.
+// The returned error wraps errSchemaInvalid and lists each failing location,
+// so the log shows exactly which field broke the contract.
+func validateMessageBody(body []byte) error {
+	if messageSchema == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("%w: %v", errSchemaInvalid, err)
+	}
+
+	err := messageSchema.Validate(document)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", errSchemaInvalid, strings.Join(schemaViolations(validationErr), "; "))
+}
+
+// schemaViolations flattens a validation error to its leaves, the only ones
+// that name the failing field and keyword.
+func schemaViolations(err *jsonschema.ValidationError) []string {
+	if len(err.Causes) == 0 {
+		location := err.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		return []string{location + ": " + err.Message}
+	}
+	var violations []string
+	for _, cause := range err.Causes {
+		violations = append(violations, schemaViolations(cause)...)
+	}
+	return violations
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+)
+
+var (
+	emptyDatesTotal            = expvar.NewInt("empty_dates_total")
+	filteredEncountersTotal    = expvar.NewInt("filtered_encounters_total")
+	outsideDateEncountersTotal = expvar.NewInt("outside_date_encounters_total")
+
+	// SQS send latency as running totals; divide by sqs_sends_total, which
+	// counts messages, for the mean. sqs_batches_total counts the
+	// SendMessageBatch calls of SQS_SENDERS.
+	sqsSendsTotal         = expvar.NewInt("sqs_sends_total")
+	sqsSendLatencySeconds = expvar.NewFloat("sqs_send_latency_seconds_total")
+	sqsQueueWaitSeconds   = expvar.NewFloat("sqs_send_queue_wait_seconds_total")
+	sqsSendTimeoutsTotal  = expvar.NewInt("sqs_send_timeouts_total")
+	sqsBatchesTotal       = expvar.NewInt("sqs_batches_total")
+)
+
+func initMetrics() {
+	addr := cfg.MetricsAddr
+	if addr == "" {
+		return
+	}
+
+	go func() {
+		slog.Info("Serving metrics on /debug/vars", "addr", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+}
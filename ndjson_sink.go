@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	sqsSinkEnabled    bool
+	ndjsonSinkEnabled bool
+)
+
+// ndjsonWriter writes one FHIRMessage per line to output/<name>.ndjson
+// (YYYY-MM-DD for dates), overwriting any file left by a previous run.
+type ndjsonWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func openNDJSONWriter(name string) (*ndjsonWriter, error) {
+	if err := os.MkdirAll(cfg.OutputDir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating output dir: %w", err)
+	}
+
+	file, err := os.Create(filepath.Join(cfg.OutputDir, name+".ndjson"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating NDJSON file: %w", err)
+	}
+
+	return &ndjsonWriter{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (w *ndjsonWriter) Write(message FHIRMessage) error {
+	body, err := renderMessage(message)
+	if err != nil {
+		return err
+	}
+	return w.WriteValue(body)
+}
+
+// WriteValue writes any message body as one NDJSON line.
+func (w *ndjsonWriter) WriteValue(body any) error {
+	line, err := fastJSON.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error converting message to JSON: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing NDJSON line: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the writer and, unless it writes to stdout, syncs and
+// closes the file.
+func (w *ndjsonWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return w.writer.Flush()
+	}
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("error flushing NDJSON file: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("error syncing NDJSON file: %w", err)
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// outputTemplate, loaded from OUTPUT_TEMPLATE, reshapes each combined
+// message. It receives the FHIRMessage (.Encounter, .Practitioner, .Patient)
+// and must render a JSON document; nil keeps the default FHIRMessage JSON.
+var outputTemplate *template.Template
+
+var outputTemplateFuncs = template.FuncMap{
+	// json renders a value as a JSON literal, quoting and escaping strings.
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func loadOutputTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OUTPUT_TEMPLATE: %w", err)
+	}
+	tmpl, err := template.New("output").Funcs(outputTemplateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OUTPUT_TEMPLATE: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderMessage returns the message body sent to the sinks: the template
+// output when OUTPUT_TEMPLATE is set, otherwise the message itself.
+func renderMessage(message FHIRMessage) (any, error) {
+	if outputTemplate == nil {
+		return message, nil
+	}
+
+	var rendered bytes.Buffer
+	if err := outputTemplate.Execute(&rendered, message); err != nil {
+		return nil, fmt.Errorf("error rendering OUTPUT_TEMPLATE: %w", err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, rendered.Bytes()); err != nil {
+		return nil, fmt.Errorf("OUTPUT_TEMPLATE did not render valid JSON: %w", err)
+	}
+	return json.RawMessage(compact.Bytes()), nil
+}
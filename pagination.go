@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+)
+
+const (
+	paginationNext   = "next"
+	paginationOffset = "offset"
+	paginationAuto   = "auto"
+)
+
+// pager yields the page URLs of a search. With the next strategy it follows
+// link[next]; with offset it increments _offset by PAGE_SIZE until an empty
+// page comes back; auto follows next links and switches to offsets when a
+// full page arrives without one, at the offset after the entries the next
+// links already returned.
+type pager struct {
+	searchURL string
+	strategy  string
+	offset    int
+}
+
+func newPager(searchURL string) *pager {
+	return &pager{searchURL: searchURL, strategy: cfg.PaginationStrategy}
+}
+
+func (p *pager) FirstPage() string {
+	if p.strategy == paginationNext {
+		return p.searchURL
+	}
+	return p.offsetPage()
+}
+
+type bundlePage struct {
+	Next    string
+	Entries int
+	Total   int
+}
+
+func (p *pager) NextPage(page bundlePage) string {
+	if p.strategy != paginationOffset {
+		if page.Next != "" {
+			p.offset += page.Entries
+			return page.Next
+		}
+		if p.strategy == paginationNext || page.Entries < cfg.PageSize {
+			return ""
+		}
+		p.offset += page.Entries
+		slog.Debug("Full page without next link, switching to offset pagination", "url", p.searchURL, "offset", p.offset)
+		p.strategy = paginationOffset
+		return p.offsetPage()
+	}
+
+	if page.Entries == 0 {
+		return ""
+	}
+	p.offset += cfg.PageSize
+	return p.offsetPage()
+}
+
+func (p *pager) offsetPage() string {
+	pageURL := withParam(p.searchURL, "_count", strconv.Itoa(cfg.PageSize))
+	return withParam(pageURL, "_offset", strconv.Itoa(p.offset))
+}
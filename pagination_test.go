@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// setConfig applies change to cfg for the duration of the test.
+func setConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	change(&cfg)
+}
+
+func queryParam(t *testing.T, pageURL string, name string) string {
+	t.Helper()
+	parsed, err := url.Parse(pageURL)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", pageURL, err)
+	}
+	return parsed.Query().Get(name)
+}
+
+func TestPagerAutoSwitchesToOffsetAfterNextLinks(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.PaginationStrategy = paginationAuto
+		c.PageSize = 50
+	})
+	p := newPager("http://fhir/Encounter?date=2024-01-15")
+	if got := queryParam(t, p.FirstPage(), "_offset"); got != "0" {
+		t.Fatalf("first page _offset = %q, want 0", got)
+	}
+
+	// Three full pages come with next links, the fourth without one.
+	for i := 0; i < 3; i++ {
+		next := "http://fhir/page-" + string(rune('2'+i))
+		if got := p.NextPage(bundlePage{Next: next, Entries: 50}); got != next {
+			t.Fatalf("page %d: NextPage = %q, want the next link %q", i+1, got, next)
+		}
+	}
+	pageURL := p.NextPage(bundlePage{Entries: 50})
+	if got := queryParam(t, pageURL, "_offset"); got != "200" {
+		t.Fatalf("after switching, _offset = %q, want 200 (past the four pages already read); url %s", got, pageURL)
+	}
+	if got := queryParam(t, pageURL, "_count"); got != "50" {
+		t.Fatalf("after switching, _count = %q, want 50", got)
+	}
+
+	pageURL = p.NextPage(bundlePage{Entries: 50})
+	if got := queryParam(t, pageURL, "_offset"); got != "250" {
+		t.Fatalf("next offset page _offset = %q, want 250", got)
+	}
+	if got := p.NextPage(bundlePage{Entries: 0}); got != "" {
+		t.Fatalf("empty page: NextPage = %q, want end of search", got)
+	}
+}
+
+func TestPagerAutoStopsOnShortPageWithoutNext(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.PaginationStrategy = paginationAuto
+		c.PageSize = 50
+	})
+	p := newPager("http://fhir/Encounter?date=2024-01-15")
+	p.FirstPage()
+	p.NextPage(bundlePage{Next: "http://fhir/page-2", Entries: 50})
+	if got := p.NextPage(bundlePage{Entries: 20}); got != "" {
+		t.Fatalf("short page without next: NextPage = %q, want end of search", got)
+	}
+}
+
+func TestPagerOffsetStrategy(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.PaginationStrategy = paginationOffset
+		c.PageSize = 50
+	})
+	p := newPager("http://fhir/Encounter?date=2024-01-15")
+	p.FirstPage()
+	for _, want := range []string{"50", "100"} {
+		pageURL := p.NextPage(bundlePage{Next: "http://fhir/ignored", Entries: 50})
+		if got := queryParam(t, pageURL, "_offset"); got != want {
+			t.Fatalf("_offset = %q, want %s", got, want)
+		}
+	}
+}
+
+func TestSearchCapacityBoundedByMaxPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxPages int
+		total    int
+		want     int
+	}{
+		{name: "unbounded", maxPages: 0, total: 5000, want: 5000},
+		{name: "below MAX_PAGES", maxPages: 10, total: 120, want: 120},
+		{name: "above MAX_PAGES", maxPages: 10, total: 1000000, want: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, func(c *Config) {
+				c.PageSize = 50
+				c.MaxPages = tt.maxPages
+			})
+			if got := searchCapacity(tt.total); got != tt.want {
+				t.Fatalf("searchCapacity(%d) = %d, want %d", tt.total, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var organizationClients map[string]string
+
+// parseOrganizationClients reads ORGANIZATION_CLIENTS in the form
+// "Organization/1=001,Organization/2=002". Keys are stored by organization
+// ID so relative and absolute references both match.
+func parseOrganizationClients(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, pair := range splitList(value) {
+		organization, client, found := strings.Cut(pair, "=")
+		organization, client = strings.TrimSpace(organization), strings.TrimSpace(client)
+		if !found || organization == "" || client == "" {
+			return nil, fmt.Errorf("invalid ORGANIZATION_CLIENTS entry %q, expected Organization/id=client", pair)
+		}
+		mapping[extractReferenceID(organization)] = client
+	}
+	return mapping, nil
+}
+
+// clientIDForMessage picks the FIFO message group of an encounter. With
+// PARTITION_BY=organization it maps the patient's managingOrganization, or
+// failing that the encounter's serviceProvider, through ORGANIZATION_CLIENTS;
+// unmapped organizations use DEFAULT_CLIENT_ID, and without one fall back to
+// the patient hash.
+func clientIDForMessage(enc Encounter, patient PatientDB, patientId string) string {
+	if cfg.PartitionBy != "organization" {
+		return clientIDForPatient(patientId)
+	}
+
+	organization := patient.ManagingOrganization
+	if organization == "" {
+		organization = enc.ServiceProvider.Reference
+	}
+	if client, ok := organizationClients[extractReferenceID(organization)]; ok && organization != "" {
+		return client
+	}
+	if cfg.DefaultClientID != "" {
+		return cfg.DefaultClientID
+	}
+	return clientIDForPatient(patientId)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// patientMessage is the message MESSAGE_FORMAT=patient sends once per
+// patient and date window: the patient once, followed by each of its
+// encounters in the window with their practitioner.
+type patientMessage struct {
+	Date       string             `json:"date,omitempty"`
+	Patient    PatientDB          `json:"patient"`
+	Encounters []patientEncounter `json:"encounters"`
+
+	Source *MessageSource `json:"source,omitempty"`
+}
+
+type patientEncounter struct {
+	Encounter    EncounterDB    `json:"encounter"`
+	Practitioner PractitionerDB `json:"practitioner"`
+}
+
+// patientGroup is a patientMessage being built, with what is needed to
+// record the outcome of each of its encounters once it is sent.
+type patientGroup struct {
+	message    patientMessage
+	patientRef string
+	clientID   string
+	fullUrls   []string
+	encounters []Encounter
+}
+
+// patientBatch holds a date window's encounters by patient until the
+// window's search is complete. Groups are sent in the order their patient
+// was first seen.
+type patientBatch struct {
+	mu     sync.Mutex
+	date   string
+	groups map[string]*patientGroup
+	order  []string
+}
+
+// activePatientBatch is the batch of the window processDate is running; nil
+// outside a date search (MODE=single, the lookback re-query), where each
+// encounter is sent as a group of its own.
+var activePatientBatch *patientBatch
+
+func newPatientBatch(date string) *patientBatch {
+	return &patientBatch{date: date, groups: map[string]*patientGroup{}}
+}
+
+// startPatientBatch makes a new batch for window the active one until the
+// returned function is called. Without MESSAGE_FORMAT=patient it is a no-op
+// and returns nil.
+func startPatientBatch(window dateWindow) (*patientBatch, func()) {
+	if cfg.MessageFormat != "patient" {
+		return nil, func() {}
+	}
+	activePatientBatch = newPatientBatch(window.Label())
+	return activePatientBatch, func() { activePatientBatch = nil }
+}
+
+// Add files the encounter's message under its patient. The same patient ID
+// on different servers is a different patient.
+func (b *patientBatch) Add(message FHIRMessage, enc Encounter, base string, clientID string) {
+	patientRef := base + "/Patient/" + message.Patient.FhirId
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	group, ok := b.groups[patientRef]
+	if !ok {
+		group = &patientGroup{
+			message:    patientMessage{Date: b.date, Patient: message.Patient, Source: message.Source},
+			patientRef: patientRef,
+			clientID:   clientID,
+		}
+		b.groups[patientRef] = group
+		b.order = append(b.order, patientRef)
+	}
+	group.message.Encounters = append(group.message.Encounters, patientEncounter{Encounter: message.Encounter, Practitioner: message.Practitioner})
+	group.fullUrls = append(group.fullUrls, message.Encounter.FullUrl)
+	group.encounters = append(group.encounters, enc)
+}
+
+// Flush writes every group to the NDJSON sink and sends it to SQS, and
+// returns how many encounters were delivered. A group that fails to send is
+// recorded against each of its encounters, as a single encounter would be.
+func (b *patientBatch) Flush(ctx context.Context, out *ndjsonWriter) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delivered := 0
+	for _, patientRef := range b.order {
+		group := b.groups[patientRef]
+		if out != nil {
+			if err := out.WriteValue(group.message); err != nil {
+				slog.Error("Erro ao escrever mensagem no arquivo NDJSON", "error", err)
+			}
+		}
+		if sqsSinkEnabled {
+			if err := enqueueSQS(ctx, group.message, patientRef, group.clientID); err != nil {
+				recordSendFailure(ctx, patientRef, group.fullUrls, err)
+				continue
+			}
+		}
+		for i, fullUrl := range group.fullUrls {
+			markVersionSent(ctx, fullUrl, group.encounters[i])
+		}
+		stats.update(func(s *runStats) { s.EncountersSent += len(group.fullUrls) })
+		delivered += len(group.fullUrls)
+	}
+	slog.Debug("Patient messages flushed", "date", b.date, "patients", len(b.order), "encounters", delivered)
+	b.groups, b.order = map[string]*patientGroup{}, nil
+	return delivered
+}
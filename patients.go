@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// runPatients ingests every encounter of a known set of patients instead of
+// walking a date range. Failed patients go to the unprocessed_patients set.
+func runPatients(ctx context.Context) {
+	patientIDs, err := loadPatientIDs(ctx)
+	if err != nil {
+		log.Fatalf("Error loading patient IDs: %v", err)
+	}
+	if len(patientIDs) == 0 {
+		log.Fatal("MODE=patients requires PATIENT_IDS, PATIENT_IDS_FILE or PATIENT_IDS_REDIS_LIST")
+	}
+
+	for i, patientID := range patientIDs {
+		if deadlineReached() {
+			slog.Warn("Run deadline reached, stopping before next patient", "remaining", len(patientIDs)-i, "deadline", runDeadline)
+			return
+		}
+		if err := processPatient(ctx, patientID); err != nil {
+			if abortOnFatal(err) {
+				return
+			}
+			slog.Error("Error processing patient, adding to unprocessed_patients", "patient", patientID, "error", err)
+			stats.update(func(s *runStats) { s.PatientsFailed++ })
+			if err := state.AddToSet(ctx, "unprocessed_patients", patientID); err != nil {
+				slog.Error("Error adding to unprocessed_patients", "error", err)
+			}
+			continue
+		}
+		stats.update(func(s *runStats) { s.PatientsProcessed++ })
+	}
+}
+
+func processPatient(ctx context.Context, patientID string) error {
+	slog.Info("Processing patient", "patient", patientID)
+	url := patientSearchURL(activeFHIRBase(), patientID)
+
+	var out *ndjsonWriter
+	if ndjsonSinkEnabled {
+		var err error
+		out, err = openNDJSONWriter(patientFileName(patientID))
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := processEncounterSearch(ctx, url, out, nil, nil)
+	if out != nil {
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Patient processed", "patient", patientID, "encounters", result.Entries, "truncated", result.Truncated)
+	return nil
+}
+
+// patientSearchURL is the Encounter search for one patient. IDs come from
+// files and Redis lists as typed, so the subject is escaped rather than
+// trusted to be a valid FHIR id.
+func patientSearchURL(base string, patientID string) string {
+	return encounterSearchURL(withParam(base+"/Encounter", "subject", "Patient/"+patientID))
+}
+
+// patientFileName is the NDJSON file name for a patient. Characters outside
+// [A-Za-z0-9._-] are replaced, and a hash of the original ID is appended
+// when any was, so two IDs never share a file.
+func patientFileName(patientID string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, patientID)
+	if safe == patientID {
+		return "patient-" + safe
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(patientID))
+	return fmt.Sprintf("patient-%s-%08x", safe, hash.Sum32())
+}
+
+func loadPatientIDs(ctx context.Context) ([]string, error) {
+	var patientIDs []string
+
+	for _, id := range strings.Split(cfg.PatientIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			patientIDs = append(patientIDs, id)
+		}
+	}
+
+	if path := cfg.PatientIDsFile; path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening PATIENT_IDS_FILE: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if id := strings.TrimSpace(scanner.Text()); id != "" {
+				patientIDs = append(patientIDs, id)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading PATIENT_IDS_FILE: %w", err)
+		}
+	}
+
+	if key := cfg.PatientIDsRedisList; key != "" {
+		ids, err := redisRetry(ctx, "lrange "+key, func() ([]string, error) {
+			return redisClient.LRange(ctx, key, 0, -1).Result()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading Redis list %s: %w", key, err)
+		}
+		patientIDs = append(patientIDs, ids...)
+	}
+
+	return patientIDs, nil
+}
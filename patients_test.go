@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatientSearchURLEscapesID(t *testing.T) {
+	setConfig(t, func(c *Config) {
+		c.SearchSort = "_lastUpdated"
+		c.EncounterSummary = ""
+		c.EncounterElements = ""
+	})
+	for _, id := range []string{"123", "a&b=c", "x#y", "with space", "50%"} {
+		searchURL := patientSearchURL("http://fhir/baseR4", id)
+		parsed, err := url.Parse(searchURL)
+		if err != nil {
+			t.Fatalf("%q: parsing %q: %v", id, searchURL, err)
+		}
+		if parsed.Fragment != "" {
+			t.Fatalf("%q: search URL %q has a fragment", id, searchURL)
+		}
+		query := parsed.Query()
+		if got := query.Get("subject"); got != "Patient/"+id {
+			t.Fatalf("%q: subject = %q in %q", id, got, searchURL)
+		}
+		if got := query.Get("_sort"); got != "_lastUpdated" {
+			t.Fatalf("%q: _sort = %q in %q", id, got, searchURL)
+		}
+		if len(query) != 2 {
+			t.Fatalf("%q: unexpected parameters %v in %q", id, query, searchURL)
+		}
+	}
+}
+
+func TestPatientFileName(t *testing.T) {
+	if got := patientFileName("abc-123.4"); got != "patient-abc-123.4" {
+		t.Fatalf("plain ID: got %q", got)
+	}
+	seen := map[string]string{}
+	for _, id := range []string{"../../etc/passwd", "a/b", "a b", "a_b", "a&b", "..", `c:\x`} {
+		name := patientFileName(id)
+		if strings.ContainsAny(name, `/\ &`) || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+			t.Fatalf("%q: unsafe file name %q", id, name)
+		}
+		if other, ok := seen[name]; ok {
+			t.Fatalf("%q and %q share the file name %q", id, other, name)
+		}
+		seen[name] = id
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+)
+
+var (
+	// practitionerSpecialties memoizes PractitionerRole lookups for the run,
+	// including practitioners without a role, so each is searched once.
+	practitionerSpecialties sync.Map
+)
+
+type PractitionerRole struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id"`
+	Specialty    []CodeableConcept `json:"specialty"`
+}
+
+type practitionerRoleBundle struct {
+	Entry []struct {
+		Resource PractitionerRole `json:"resource"`
+	} `json:"entry"`
+}
+
+// practitionerRoleURL is the PractitionerRole search for one practitioner,
+// with the ID escaped like any other search parameter.
+func practitionerRoleURL(base string, practitionerId string) string {
+	return withParam(base+"/PractitionerRole", "practitioner", practitionerId)
+}
+
+// lookupPractitionerSpecialty returns the first specialty coding of the
+// practitioner's PractitionerRole. Failures are logged and treated as no
+// specialty, since the field is optional.
+func lookupPractitionerSpecialty(ctx context.Context, base string, practitionerId string) (Coding, bool) {
+	if cached, ok := practitionerSpecialties.Load(practitionerId); ok {
+		coding := cached.(Coding)
+		return coding, coding.Code != ""
+	}
+
+	roleURL := practitionerRoleURL(base, practitionerId)
+	slog.Debug("Buscando PractitionerRole", "url", roleURL)
+	release, err := acquireReferenceSlot(ctx)
+	if err != nil {
+		return Coding{}, false
+	}
+	data, err := fetchDataWithRetry(ctx, roleURL, cfg.FetchMaxRetries)
+	release()
+	if err != nil {
+		slog.Warn("Erro ao buscar PractitionerRole", "practitioner", practitionerId, "error", err)
+		return Coding{}, false
+	}
+
+	var bundle practitionerRoleBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		slog.Warn("Erro ao parsear JSON do PractitionerRole", "practitioner", practitionerId, "error", err)
+		return Coding{}, false
+	}
+
+	var specialty Coding
+	for _, entry := range bundle.Entry {
+		for _, concept := range entry.Resource.Specialty {
+			if coding, ok := concept.FirstCoding(); ok {
+				specialty = coding
+				break
+			}
+		}
+		if specialty.Code != "" {
+			break
+		}
+	}
+
+	practitionerSpecialties.Store(practitionerId, specialty)
+	return specialty, specialty.Code != ""
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// pagePrefetch is the first search page of an upcoming date window, fetched
+// in the background while the current window's encounters are processed
+// (PREFETCH_NEXT_DATE). Only the raw page is fetched ahead: its entries are
+// dispatched, and the cursor advanced, when its window's turn comes.
+type pagePrefetch struct {
+	URL  string
+	done chan struct{}
+	data []byte
+	base string
+	err  error
+}
+
+func prefetchPage(ctx context.Context, pageURL string) *pagePrefetch {
+	prefetch := &pagePrefetch{URL: pageURL, done: make(chan struct{})}
+	go func() {
+		defer close(prefetch.done)
+		slog.Debug("Prefetching first page of next date", "url", pageURL)
+		prefetch.data, prefetch.base, prefetch.err = retryFetchFailover(ctx, pageURL, cfg.FetchMaxRetries, fetchData)
+	}()
+	return prefetch
+}
+
+// Wait blocks until the prefetch finishes and returns its body and the base
+// of the server that returned it.
+func (p *pagePrefetch) Wait() ([]byte, string, error) {
+	<-p.done
+	return p.data, p.base, p.err
+}
+
+// firstPageURL is the URL processDate requests first for a window, which a
+// prefetch must match to be used.
+func (w dateWindow) firstPageURL() string {
+	return newPager(w.QueryURL()).FirstPage()
+}
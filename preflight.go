@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+type preflightCheck struct {
+	Name string
+	Run  func(ctx context.Context) (string, error)
+}
+
+// runPreflight verifies the wiring of a run (MODE=preflight) without
+// processing any data. Configuration has already been validated by
+// loadConfig by the time it runs. It returns false when any check fails.
+func runPreflight(ctx context.Context) bool {
+	checks := []preflightCheck{
+		{Name: "config", Run: func(ctx context.Context) (string, error) {
+			return "configuration is valid", nil
+		}},
+		{Name: "fhir", Run: preflightFHIR},
+		{Name: "capabilities", Run: func(ctx context.Context) (string, error) {
+			return "required searches declared in CapabilityStatement", checkCapabilities(ctx)
+		}},
+		{Name: "state", Run: func(ctx context.Context) (string, error) {
+			return state.Describe(ctx)
+		}},
+	}
+	if cfg.CertExpiryWarning > 0 {
+		checks = append(checks, preflightCheck{Name: "tls", Run: func(ctx context.Context) (string, error) {
+			return "FHIR certificates read, see expiry above", checkCertExpiry(ctx)
+		}})
+	}
+	if sqsSinkEnabled {
+		checks = append(checks, preflightCheck{Name: "sqs", Run: preflightSQS})
+	}
+
+	passed := true
+	for _, check := range checks {
+		detail, err := check.Run(ctx)
+		if err != nil {
+			passed = false
+			slog.Error("Preflight check FAILED", "check", check.Name, "error", err)
+			continue
+		}
+		slog.Info("Preflight check passed", "check", check.Name, "detail", detail)
+	}
+
+	if passed {
+		slog.Info("Preflight PASSED", "checks", len(checks))
+	} else {
+		slog.Error("Preflight FAILED, fix the errors above before starting a run")
+	}
+	return passed
+}
+
+// preflightFHIR fetches a single encounter from every configured server,
+// which also proves that each accepts the request as sent.
+func preflightFHIR(ctx context.Context) (string, error) {
+	var reports []string
+	for _, server := range fhirServers {
+		url := withParam(server.Base+"/Encounter", "_count", "1")
+		data, err := fetchData(ctx, url)
+		if err != nil {
+			return "", fmt.Errorf("fetching %s: %w", url, err)
+		}
+
+		var bundle Bundle
+		if err := json.Unmarshal(data, &bundle); err != nil {
+			return "", fmt.Errorf("parsing Encounter bundle from %s: %w", server.Base, err)
+		}
+		reports = append(reports, fmt.Sprintf("%s reachable, %d encounter(s) returned", server.Base, len(bundle.Entry)))
+	}
+	return strings.Join(reports, "; "), nil
+}
+
+// preflightSQS reads the queue attributes to confirm the queue exists and to
+// report whether it is FIFO, which the MessageGroupId sent by sendToSQS needs.
+func preflightSQS(ctx context.Context) (string, error) {
+	client, err := newSQSClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(cfg.SQSQueueURL),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameFifoQueue},
+	})
+	if err != nil {
+		return "", fmt.Errorf("reading attributes of %s: %w", cfg.SQSQueueURL, err)
+	}
+
+	if strings.EqualFold(output.Attributes[string(types.QueueAttributeNameFifoQueue)], "true") {
+		return cfg.SQSQueueURL + " reachable, FIFO queue", nil
+	}
+	return "", fmt.Errorf("%s is a standard queue, but messages are sent with a MessageGroupId and need a FIFO queue", cfg.SQSQueueURL)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UnmarshalJSON decodes an Encounter and, with ENCOUNTER_PROFILE_ELEMENTS,
+// records which of the required elements the resource lacks. The check runs
+// on the raw resource because the struct only models the elements the
+// transform uses.
+func (e *Encounter) UnmarshalJSON(data []byte) error {
+	type plain Encounter
+	if err := fastJSON.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	required := cfg.EncounterProfileElementList()
+	if len(required) == 0 {
+		return nil
+	}
+	var resource any
+	if err := fastJSON.Unmarshal(data, &resource); err != nil {
+		return err
+	}
+	e.missingElements = nil
+	for _, path := range required {
+		if !hasElement(resource, strings.Split(path, ".")) {
+			e.missingElements = append(e.missingElements, path)
+		}
+	}
+	return nil
+}
+
+// hasElement reports whether the dotted path leads to a non-empty value.
+// Along a repeating element, any repetition that has the rest of the path
+// is enough, e.g. participant.individual.
+func hasElement(value any, path []string) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case []any:
+		for _, item := range v {
+			if hasElement(item, path) {
+				return true
+			}
+		}
+		return false
+	case map[string]any:
+		if len(path) == 0 {
+			return len(v) > 0
+		}
+		return hasElement(v[path[0]], path[1:])
+	case string:
+		return len(path) == 0 && v != ""
+	default:
+		return len(path) == 0
+	}
+}
+
+// profileError reports why an encounter does not conform to
+// ENCOUNTER_PROFILE: the profile missing from meta.profile, or required
+// elements absent. Profiles are compared without their |version suffix.
+func profileError(enc Encounter) error {
+	var problems []string
+	if cfg.EncounterProfile != "" {
+		claimed := false
+		for _, profile := range enc.Meta.Profile {
+			canonical, _, _ := strings.Cut(profile, "|")
+			if canonical == cfg.EncounterProfile {
+				claimed = true
+				break
+			}
+		}
+		if !claimed {
+			problems = append(problems, fmt.Sprintf("meta.profile does not include %s", cfg.EncounterProfile))
+		}
+	}
+	if len(enc.missingElements) > 0 {
+		problems = append(problems, "missing "+strings.Join(enc.missingElements, ", "))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+// profileElementsToRequest is the top-level elements the profile check
+// needs from the server, merged into ENCOUNTER_ELEMENTS.
+func profileElementsToRequest(profile string, required []string) string {
+	var elements []string
+	if profile != "" {
+		elements = append(elements, "meta")
+	}
+	for _, path := range required {
+		top, _, _ := strings.Cut(path, ".")
+		if !slices.Contains(elements, top) {
+			elements = append(elements, top)
+		}
+	}
+	return strings.Join(elements, ",")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// suppressWrite reports whether READONLY suppresses a state write, logging
+// the write that would have happened instead. Reads are never affected, so
+// a READONLY run sees production state but leaves it untouched.
+func suppressWrite(command string, key string, attrs ...any) bool {
+	if !cfg.ReadOnly {
+		return false
+	}
+	slog.Info("READONLY: write suppressed", append([]any{"command", command, "key", key}, attrs...)...)
+	return true
+}
+
+// readOnlyStateStore passes reads through to the configured store and logs
+// cursor and set writes without applying them.
+type readOnlyStateStore struct {
+	stateStore
+}
+
+func (s readOnlyStateStore) SetCursor(ctx context.Context, name string, value string) error {
+	suppressWrite("set", name, "value", value)
+	return nil
+}
+
+func (s readOnlyStateStore) AddToSet(ctx context.Context, set string, members ...string) error {
+	suppressWrite("sadd", set, "members", members)
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisRetry runs a Redis command up to REDIS_MAX_ATTEMPTS times, doubling
+// REDIS_RETRY_BACKOFF between attempts, so a short Valkey outage does not
+// lose a cursor update or a set entry. redis.Nil is a result, not a failure,
+// and is returned at once; waiting stops early if ctx is done.
+func redisRetry[T any](ctx context.Context, op string, command func() (T, error)) (T, error) {
+	var result T
+	var err error
+	wait := cfg.RedisRetryBackoff
+	for attempt := 1; attempt <= cfg.RedisMaxAttempts; attempt++ {
+		result, err = command()
+		if err == nil || errors.Is(err, redis.Nil) {
+			return result, err
+		}
+		if isRedisPoolTimeout(err) {
+			err = fmt.Errorf("Redis connection pool exhausted (%d connections, waited %s; raise REDIS_POOL_SIZE): %w",
+				redisClient.Options().PoolSize, cfg.RedisPoolTimeout, err)
+		}
+		if attempt == cfg.RedisMaxAttempts {
+			break
+		}
+
+		slog.Warn("Redis command failed, retrying", "op", op, "attempt", attempt, "maxAttempts", cfg.RedisMaxAttempts, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	return result, err
+}
+
+// isRedisPoolTimeout matches the client's pool timeout error, which is not
+// exported by go-redis v8.
+func isRedisPoolTimeout(err error) bool {
+	return err != nil && err.Error() == "redis: connection pool timeout"
+}
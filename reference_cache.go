@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	errReferenceAbsent = errors.New("reference known to be absent")
+)
+
+type referenceState int
+
+const (
+	referenceNotFetched referenceState = iota
+	referenceCached
+	referenceAbsent
+)
+
+const absentMarker = "absent"
+
+// lookupCachedReference reads a parsed PractitionerDB/PatientDB stored under
+// reference:<Type/id> when REFERENCE_CACHE is on. A missing key means the
+// reference was never fetched; the absent marker means the server returned
+// 404 for it before.
+func lookupCachedReference(ctx context.Context, reference string, target any) (referenceState, error) {
+	if !cfg.ReferenceCache {
+		return referenceNotFetched, nil
+	}
+
+	value, err := redisClient.Get(ctx, "reference:"+reference).Result()
+	if err == redis.Nil {
+		return referenceNotFetched, nil
+	}
+	if err != nil {
+		slog.Error("Error reading cached reference", "reference", reference, "error", err)
+		return referenceNotFetched, err
+	}
+	if value == absentMarker {
+		return referenceAbsent, nil
+	}
+
+	if err := fastJSON.Unmarshal([]byte(value), target); err != nil {
+		slog.Error("Error parsing cached reference", "reference", reference, "error", err)
+		return referenceNotFetched, err
+	}
+	slog.Debug("Reference cache hit", "reference", reference)
+	return referenceCached, nil
+}
+
+func storeCachedReference(ctx context.Context, reference string, value any) {
+	if !cfg.ReferenceCache {
+		return
+	}
+
+	data, err := fastJSON.Marshal(value)
+	if err != nil {
+		slog.Error("Error converting reference to JSON", "reference", reference, "error", err)
+		return
+	}
+	if suppressWrite("set", "reference:"+reference) {
+		return
+	}
+	if _, err := redisClient.Set(ctx, "reference:"+reference, data, cfg.ReferenceCacheTTL).Result(); err != nil {
+		slog.Error("Error caching reference", "reference", reference, "error", err)
+	}
+}
+
+// isReferenceNotFound reports whether err means the server has no such
+// resource, either from a 404 now or from an absent marker cached earlier.
+func isReferenceNotFound(err error) bool {
+	if errors.Is(err, errReferenceAbsent) {
+		return true
+	}
+	var statusErr *statusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound
+}
+
+func markReferenceAbsentOnNotFound(ctx context.Context, reference string, err error) {
+	if !cfg.ReferenceCache || !isReferenceNotFound(err) {
+		return
+	}
+	if suppressWrite("set", "reference:"+reference, "value", absentMarker) {
+		return
+	}
+	if _, err := redisClient.Set(ctx, "reference:"+reference, absentMarker, cfg.ReferenceCacheTTL).Result(); err != nil {
+		slog.Error("Error caching absent reference", "reference", reference, "error", err)
+	}
+}
+
+// referenceFetchSlots bounds concurrent Practitioner, Patient and
+// PractitionerRole requests to REFERENCE_FETCH_CONCURRENCY, independently of
+// how many encounters are in flight. Nil means unbounded.
+var referenceFetchSlots chan struct{}
+
+// acquireReferenceSlot waits for a free reference fetch slot and returns the
+// function that frees it.
+func acquireReferenceSlot(ctx context.Context) (func(), error) {
+	if referenceFetchSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case referenceFetchSlots <- struct{}{}:
+		return func() { <-referenceFetchSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchReferenceWithRetry fetches a Practitioner/Patient, revalidating a
+// previously stored copy with ETag/Last-Modified when CONDITIONAL_FETCH is on.
+func fetchReferenceWithRetry(ctx context.Context, url string, maxRetries int) ([]byte, error) {
+	release, err := acquireReferenceSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if !cfg.ConditionalFetch {
+		return fetchDataWithRetry(ctx, url, maxRetries)
+	}
+
+	key := "reference_etag:" + url
+	cached, err := redisClient.HGetAll(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		slog.Error("Error reading cached reference", "url", url, "error", err)
+	}
+	validators := cacheValidators{
+		ETag:         cached["etag"],
+		LastModified: cached["lastModified"],
+	}
+	if cached["body"] == "" {
+		validators = cacheValidators{}
+	}
+
+	body, _, err := retryFetchFailover(ctx, url, maxRetries, func(ctx context.Context, url string) ([]byte, error) {
+		body, newValidators, err := fetchDataConditional(ctx, url, validators)
+		if errors.Is(err, errNotModified) {
+			slog.Debug("Reference not modified, using cached body", "url", url)
+			return []byte(cached["body"]), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if (newValidators.ETag != "" || newValidators.LastModified != "") && !suppressWrite("hset", key) {
+			_, err := redisClient.HSet(ctx, key,
+				"body", string(body),
+				"etag", newValidators.ETag,
+				"lastModified", newValidators.LastModified,
+			).Result()
+			if err != nil {
+				slog.Error("Error caching reference", "url", url, "error", err)
+			}
+		}
+		return body, nil
+	})
+	return body, err
+}
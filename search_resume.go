@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// searchProgressTTL bounds how long an abandoned search's checkpoint and
+// sent set stay in Redis.
+const searchProgressTTL = 7 * 24 * time.Hour
+
+// searchCheckpoint is the earliest page of a search that may still have
+// unsent encounters, with the pager state and counters at that point.
+type searchCheckpoint struct {
+	URL      string `json:"url"`
+	Strategy string `json:"strategy"`
+	Offset   int    `json:"offset"`
+	Pages    int    `json:"pages"`
+	Entries  int    `json:"entries"`
+	Total    int    `json:"total"`
+}
+
+// searchResume persists the pagination of one search under
+// RESUME_PAGINATION, so a run that crashes mid-date restarts from the last
+// checkpointed page instead of page 1. Encounters sent since the checkpoint
+// are kept in a set and skipped when the page is fetched again.
+type searchResume struct {
+	checkpointKey string
+	sentKey       string
+	resumed       bool
+}
+
+func newSearchResume(searchURL string) *searchResume {
+	sum := sha1.Sum([]byte(searchURL))
+	id := hex.EncodeToString(sum[:])
+	return &searchResume{
+		checkpointKey: "search_checkpoint:" + id,
+		sentKey:       "search_sent:" + id,
+	}
+}
+
+func (r *searchResume) Load(ctx context.Context) (searchCheckpoint, bool) {
+	var checkpoint searchCheckpoint
+	data, err := redisRetry(ctx, "get "+r.checkpointKey, func() (string, error) {
+		return redisClient.Get(ctx, r.checkpointKey).Result()
+	})
+	if err == redis.Nil {
+		return checkpoint, false
+	}
+	if err != nil {
+		slog.Error("Error reading search checkpoint, starting from the first page", "key", r.checkpointKey, "error", err)
+		return checkpoint, false
+	}
+	if err := json.Unmarshal([]byte(data), &checkpoint); err != nil {
+		slog.Error("Error parsing search checkpoint, starting from the first page", "key", r.checkpointKey, "error", err)
+		return checkpoint, false
+	}
+	r.resumed = true
+	return checkpoint, true
+}
+
+func (r *searchResume) Save(ctx context.Context, checkpoint searchCheckpoint) {
+	if suppressWrite("set", r.checkpointKey, "page", checkpoint.Pages+1) {
+		return
+	}
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		slog.Error("Error converting search checkpoint to JSON", "error", err)
+		return
+	}
+	if _, err := redisRetry(ctx, "set "+r.checkpointKey, func() (string, error) {
+		return redisClient.Set(ctx, r.checkpointKey, data, searchProgressTTL).Result()
+	}); err != nil {
+		slog.Error("Error saving search checkpoint", "key", r.checkpointKey, "error", err)
+	}
+}
+
+// AlreadySent only consults Redis for a resumed search; a fresh one has
+// nothing recorded yet.
+func (r *searchResume) AlreadySent(ctx context.Context, fullUrl string) bool {
+	if !r.resumed {
+		return false
+	}
+	sent, err := redisRetry(ctx, "sismember "+r.sentKey, func() (bool, error) {
+		return redisClient.SIsMember(ctx, r.sentKey, fullUrl).Result()
+	})
+	if err != nil {
+		slog.Error("Error checking sent encounters, processing again", "key", r.sentKey, "error", err)
+		return false
+	}
+	return sent
+}
+
+func (r *searchResume) MarkSent(ctx context.Context, fullUrl string) {
+	if suppressWrite("sadd", r.sentKey, "member", fullUrl) {
+		return
+	}
+	if _, err := redisRetry(ctx, "sadd "+r.sentKey, func() (int64, error) {
+		added, err := redisClient.SAdd(ctx, r.sentKey, fullUrl).Result()
+		if err == nil && added == 1 {
+			redisClient.Expire(ctx, r.sentKey, searchProgressTTL)
+		}
+		return added, err
+	}); err != nil {
+		slog.Error("Error recording sent encounter", "key", r.sentKey, "error", err)
+	}
+}
+
+// isExpiredPageLink reports whether a checkpointed page URL was rejected as
+// gone rather than failing transiently.
+func isExpiredPageLink(err error) bool {
+	var statusErr *statusError
+	return errors.As(err, &statusErr) &&
+		(statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone || statusErr.StatusCode == http.StatusBadRequest)
+}
+
+// Clear drops the checkpoint and sent set once the search completed.
+func (r *searchResume) Clear(ctx context.Context) {
+	if suppressWrite("del", r.checkpointKey) {
+		return
+	}
+	if _, err := redisRetry(ctx, "del "+r.checkpointKey, func() (int64, error) {
+		return redisClient.Del(ctx, r.checkpointKey, r.sentKey).Result()
+	}); err != nil {
+		slog.Error("Error clearing search checkpoint", "key", r.checkpointKey, "error", err)
+	}
+	r.resumed = false
+}
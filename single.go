@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// runSingle runs the full pipeline on one encounter (MODE=single), for
+// reproducing data-specific problems. The date cursor is never read or
+// written. Unless SINGLE_SEND is on, the message is only printed to stdout;
+// with it, the configured SINKS receive it as in a normal run.
+func runSingle(ctx context.Context) {
+	encounterURL := cfg.EncounterURL
+	if !strings.Contains(encounterURL, "://") {
+		encounterURL = activeFHIRBase() + "/" + strings.TrimPrefix(encounterURL, "/")
+	}
+	slog.Info("Reprocessing single encounter", "url", encounterURL, "send", cfg.SingleSend)
+
+	data, err := fetchDataWithRetry(ctx, withElements(encounterURL, cfg.EncounterElements), cfg.FetchMaxRetries)
+	if err != nil {
+		slog.Error("Erro ao buscar encontro", "url", encounterURL, "error", err)
+		processExitCode = exitAborted
+		return
+	}
+	var enc Encounter
+	if err := fastJSON.Unmarshal(data, &enc); err != nil {
+		slog.Error("Erro ao parsear JSON do encontro", "url", encounterURL, "error", err)
+		processExitCode = exitAborted
+		return
+	}
+
+	var out *ndjsonWriter
+	if !cfg.SingleSend {
+		sqsSinkEnabled = false
+		out = newStdoutWriter()
+	} else if ndjsonSinkEnabled {
+		out, err = openNDJSONWriter("encounter-" + enc.ID)
+		if err != nil {
+			slog.Error("Erro ao abrir arquivo NDJSON", "error", err)
+			processExitCode = exitAborted
+			return
+		}
+	}
+
+	sent := processEncounter(ctx, enc, encounterBase(encounterURL), encounterURL, out)
+	if out != nil {
+		if err := out.Close(); err != nil {
+			slog.Error("Erro ao fechar saída NDJSON", "error", err)
+		}
+	}
+	if !sent {
+		slog.Warn("Encontro não foi enviado, veja os logs acima para o motivo", "url", encounterURL)
+		processExitCode = exitPartialFailure
+		return
+	}
+	slog.Info("Encontro processado", "url", encounterURL)
+}
+
+// encounterBase is the server part of an Encounter URL, against which its
+// references are resolved, e.g. https://fhir/baseR4 for
+// https://fhir/baseR4/Encounter/123/_history/2.
+func encounterBase(encounterURL string) string {
+	if i := strings.LastIndex(encounterURL, "/Encounter/"); i > 0 {
+		return encounterURL[:i]
+	}
+	return activeFHIRBase()
+}
+
+// newStdoutWriter writes messages to stdout in the NDJSON sink's format.
+func newStdoutWriter() *ndjsonWriter {
+	return &ndjsonWriter{writer: bufio.NewWriter(os.Stdout)}
+}
+
+// singleModeFlags copies the MODE=single command-line flags into the
+// environment, so they override the config file like any variable.
+func singleModeFlags(encounterURL string, send bool) error {
+	if encounterURL != "" {
+		if err := os.Setenv("ENCOUNTER_URL", encounterURL); err != nil {
+			return fmt.Errorf("error applying -url: %w", err)
+		}
+	}
+	if send {
+		if err := os.Setenv("SINGLE_SEND", "true"); err != nil {
+			return fmt.Errorf("error applying -send: %w", err)
+		}
+	}
+	return nil
+}
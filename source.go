@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// MessageSource identifies the FHIR server a message's data was read from,
+// for deployments that read from several (INCLUDE_SOURCE). The version
+// fields come from the server's CapabilityStatement and are empty when it
+// could not be read.
+type MessageSource struct {
+	BaseURL         string `json:"baseUrl"`
+	FHIRVersion     string `json:"fhirVersion,omitempty"`
+	SoftwareName    string `json:"softwareName,omitempty"`
+	SoftwareVersion string `json:"softwareVersion,omitempty"`
+}
+
+// loadServerSources reads each server's CapabilityStatement once, before
+// any encounter is processed. A server that does not answer is still
+// reported by its base URL.
+func loadServerSources(ctx context.Context) {
+	for _, server := range fhirServers {
+		server.Source = MessageSource{BaseURL: server.Base}
+
+		data, err := fetchData(ctx, server.Base+"/metadata")
+		if err != nil {
+			slog.Warn("Error fetching CapabilityStatement, messages will carry only the base URL", "base", server.Base, "error", err)
+			continue
+		}
+		var capability CapabilityStatement
+		if err := json.Unmarshal(data, &capability); err != nil {
+			slog.Warn("Error parsing CapabilityStatement, messages will carry only the base URL", "base", server.Base, "error", err)
+			continue
+		}
+		server.Source.FHIRVersion = capability.FHIRVersion
+		server.Source.SoftwareName = capability.Software.Name
+		server.Source.SoftwareVersion = capability.Software.Version
+		slog.Info("FHIR server source", "base", server.Base, "fhirVersion", capability.FHIRVersion, "software", capability.Software.Name, "version", capability.Software.Version)
+	}
+}
+
+// messageSource describes base, the server an encounter was read from. A
+// base outside the configured servers, such as the one in a MODE=single
+// URL, carries no version.
+func messageSource(base string) *MessageSource {
+	for _, server := range fhirServers {
+		if server.Base == base {
+			source := server.Source
+			return &source
+		}
+	}
+	return &MessageSource{BaseURL: base}
+}
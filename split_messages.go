@@ -0,0 +1,62 @@
+package main
+
+import "context"
+
+// resourceMessage is one resource of an encounter when MESSAGE_FORMAT=split.
+// The three messages of an encounter share CorrelationID (the encounter's
+// fullUrl) and its message group, and are sent practitioner, patient,
+// encounter so a FIFO consumer always has the referenced resources first.
+type resourceMessage struct {
+	ResourceType  string `json:"resourceType"`
+	CorrelationID string `json:"correlationId"`
+	Resource      any    `json:"resource"`
+
+	Source *MessageSource `json:"source,omitempty"`
+}
+
+func sendMessage(ctx context.Context, message FHIRMessage, clientID string) error {
+	if cfg.MessageFormat != "split" {
+		finish := func(error) {}
+		if cfg.DedupReferences && !cfg.EncounterOnly {
+			finish = dedupCombinedMessage(ctx, &message)
+		}
+		body, err := renderMessage(message)
+		if err == nil {
+			err = enqueueSQS(ctx, body, message.Encounter.FullUrl, clientID)
+		}
+		finish(err)
+		return err
+	}
+
+	fullUrl := message.Encounter.FullUrl
+	shared := []struct {
+		resourceType string
+		id           string
+		resource     any
+		missing      bool
+	}{
+		{"Practitioner", message.Practitioner.FhirId, message.Practitioner, message.PractitionerMissing},
+		{"Patient", message.Patient.FhirId, message.Patient, message.PatientMissing},
+	}
+	for _, item := range shared {
+		// A reference skipped under MISSING_REFERENCE=skip, or never fetched
+		// under ENCOUNTER_ONLY, has no data to send.
+		if item.missing || cfg.EncounterOnly {
+			continue
+		}
+		claim, sent := claimResource(ctx, item.resourceType, item.id)
+		if sent {
+			continue
+		}
+		if claim == nil {
+			return ctx.Err()
+		}
+		err := enqueueSQS(ctx, resourceMessage{ResourceType: item.resourceType, CorrelationID: fullUrl, Resource: item.resource, Source: message.Source}, fullUrl, clientID)
+		claim.finish(ctx, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return enqueueSQS(ctx, resourceMessage{ResourceType: "Encounter", CorrelationID: fullUrl, Resource: message.Encounter, Source: message.Source}, fullUrl, clientID)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxSQSBatchEntries is the SendMessageBatch limit on entries per call; the
+// entries together must also fit in maxSQSMessageBytes.
+const maxSQSBatchEntries = 10
+
+// sqsSendJob is one message handed to a sender goroutine; the worker that
+// produced it waits on result.
+type sqsSendJob struct {
+	ctx      context.Context
+	message  any
+	fullUrl  string
+	clientID string
+	queued   time.Time
+	result   chan error
+}
+
+// sqsSenderQueues feed the SQS_SENDERS sender goroutines. Every message of a
+// MessageGroupId goes through the same queue, so a group is never reordered
+// between enqueue and send. Nil means workers send inline.
+var sqsSenderQueues []chan sqsSendJob
+
+// startSQSSenders starts the sender goroutines. Each sends what is waiting
+// in its queue with SendMessageBatch, up to maxSQSBatchEntries per call,
+// without waiting for a batch to fill.
+func startSQSSenders(senders int) {
+	for i := 0; i < senders; i++ {
+		queue := make(chan sqsSendJob, 100)
+		sqsSenderQueues = append(sqsSenderQueues, queue)
+		go func() {
+			for job := range queue {
+				batch := []sqsSendJob{job}
+				for len(batch) < maxSQSBatchEntries && len(queue) > 0 {
+					batch = append(batch, <-queue)
+				}
+				sendSQSBatch(batch)
+			}
+		}()
+	}
+}
+
+// enqueueSQS sends a message through the sender pool, or directly when
+// SQS_SENDERS is 0, and returns the send result.
+func enqueueSQS(ctx context.Context, message any, fullUrl string, clientID string) error {
+	if len(sqsSenderQueues) == 0 {
+		return sendToSQS(ctx, message, fullUrl, clientID)
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(clientID))
+	queue := sqsSenderQueues[hash.Sum32()%uint32(len(sqsSenderQueues))]
+
+	job := sqsSendJob{ctx: ctx, message: message, fullUrl: fullUrl, clientID: clientID, queued: time.Now(), result: make(chan error, 1)}
+	select {
+	case queue <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-job.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// batchedSQSMessage is a job of a batch once its message is prepared.
+type batchedSQSMessage struct {
+	job   sqsSendJob
+	ctx   context.Context
+	span  trace.Span
+	entry sqsEntry
+}
+
+// finish ends the message's span and hands the result to its worker.
+func (m batchedSQSMessage) finish(err error) {
+	endSpan(m.span, err)
+	m.job.result <- err
+}
+
+// sendSQSBatch prepares the jobs' messages and sends them in as few
+// SendMessageBatch calls as the size limit allows, keeping their order. Each
+// job gets its own result: a message that cannot be prepared or that SQS
+// rejects fails alone, and the worker records it like a failed SendMessage.
+func sendSQSBatch(jobs []sqsSendJob) {
+	var ready []batchedSQSMessage
+	size := 0
+	for _, job := range jobs {
+		sqsQueueWaitSeconds.Add(time.Since(job.queued).Seconds())
+		ctx, span := startSQSSpan(job.ctx, job.fullUrl, job.clientID)
+		message := batchedSQSMessage{job: job, ctx: ctx, span: span}
+		if err := job.ctx.Err(); err != nil {
+			message.finish(err)
+			continue
+		}
+		if sqsClient == nil {
+			message.finish(errors.New("SQS client not initialized"))
+			continue
+		}
+		entry, err := prepareSQSMessage(ctx, job.message, job.clientID)
+		if err != nil {
+			message.finish(err)
+			continue
+		}
+		message.entry = entry
+
+		if size+entry.size() > maxSQSMessageBytes {
+			sendSQSMessageBatch(ready)
+			ready, size = nil, 0
+		}
+		ready = append(ready, message)
+		size += entry.size()
+	}
+	if len(ready) > 0 {
+		sendSQSMessageBatch(ready)
+	}
+}
+
+// sendSQSMessageBatch makes one SendMessageBatch call. Entries are
+// identified by their index in messages.
+func sendSQSMessageBatch(messages []batchedSQSMessage) {
+	entries := make([]types.SendMessageBatchRequestEntry, len(messages))
+	for i, message := range messages {
+		entries[i] = types.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       aws.String(string(message.entry.body)),
+			MessageGroupId:    aws.String(message.job.clientID),
+			MessageAttributes: message.entry.attributes,
+		}
+	}
+
+	slog.Debug("Sending message batch to SQS", "messages", len(messages))
+	// One worker giving up must not fail the others' messages, so the call
+	// is not tied to any job's context.
+	sendCtx, cancel := sqsSendContext(context.Background())
+	defer cancel()
+	sendStart := time.Now()
+	output, err := sqsClient.SendMessageBatch(sendCtx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(cfg.SQSQueueURL),
+		Entries:  entries,
+	})
+	latency := time.Since(sendStart)
+	sqsBatchesTotal.Add(1)
+	sqsSendsTotal.Add(int64(len(messages)))
+	for _, message := range messages {
+		sqsSendLatencySeconds.Add(latency.Seconds())
+		message.span.SetAttributes(attribute.Float64("sqs.send_latency_ms", float64(latency.Microseconds())/1000))
+	}
+	if err != nil {
+		err = sqsCallError(sendCtx, err)
+		for _, message := range messages {
+			message.finish(err)
+		}
+		return
+	}
+
+	results := make([]error, len(messages))
+	for i := range results {
+		results[i] = errors.New("error sending message to SQS: no result for batch entry")
+	}
+	for _, failed := range output.Failed {
+		if i, ok := batchEntryIndex(failed.Id, len(messages)); ok {
+			results[i] = fmt.Errorf("error sending message to SQS: %s: %s", aws.ToString(failed.Code), aws.ToString(failed.Message))
+		}
+	}
+	for _, sent := range output.Successful {
+		if i, ok := batchEntryIndex(sent.Id, len(messages)); ok {
+			results[i] = nil
+			message := messages[i]
+			recordSQSSent(message.ctx, message.entry, message.job.fullUrl, message.job.clientID, aws.ToString(sent.MessageId))
+		}
+	}
+	for i, message := range messages {
+		message.finish(results[i])
+		if results[i] == nil {
+			slog.Debug("Message successfully sent to SQS", "client", message.job.clientID, "latency", latency)
+		}
+	}
+}
+
+func batchEntryIndex(id *string, entries int) (int, bool) {
+	i, err := strconv.Atoi(aws.ToString(id))
+	return i, err == nil && i >= 0 && i < entries
+}
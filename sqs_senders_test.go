@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQSBatch serves SendMessageBatch, failing the entries whose body
+// contains "reject", and returns the size of every call.
+func fakeSQSBatch(t *testing.T) *[]int {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "AmazonSQS.SendMessageBatch" {
+			t.Errorf("unexpected SQS call %s", target)
+			http.Error(w, "unexpected call", http.StatusBadRequest)
+			return
+		}
+		var input struct {
+			Entries []struct{ Id, MessageBody string }
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("decoding SendMessageBatch: %v", err)
+		}
+		mu.Lock()
+		calls = append(calls, len(input.Entries))
+		mu.Unlock()
+
+		type success struct{ Id, MessageId, MD5OfMessageBody string }
+		type failure struct {
+			Id, Code, Message string
+			SenderFault       bool
+		}
+		output := struct {
+			Successful []success
+			Failed     []failure
+		}{Successful: []success{}, Failed: []failure{}}
+		for _, entry := range input.Entries {
+			if strings.Contains(entry.MessageBody, "reject") {
+				output.Failed = append(output.Failed, failure{Id: entry.Id, Code: "InternalError", Message: "try again"})
+				continue
+			}
+			sum := md5.Sum([]byte(entry.MessageBody))
+			output.Successful = append(output.Successful, success{Id: entry.Id, MessageId: "m-" + entry.Id, MD5OfMessageBody: hex.EncodeToString(sum[:])})
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		json.NewEncoder(w).Encode(output)
+	}))
+	t.Cleanup(server.Close)
+
+	setConfig(t, func(c *Config) {
+		c.SQSEndpoint = server.URL
+		c.SQSQueueURL = server.URL + "/queue/encounters.fifo"
+		c.SQSCompression = false
+		c.MessageSchema = ""
+	})
+	client, err := newSQSClient(context.Background())
+	if err != nil {
+		t.Fatalf("creating SQS client: %v", err)
+	}
+	saved := sqsClient
+	sqsClient = client
+	t.Cleanup(func() { sqsClient = saved })
+	return &calls
+}
+
+func TestSendSQSBatchReportsEachEntry(t *testing.T) {
+	calls := fakeSQSBatch(t)
+
+	bodies := []string{"first", "reject me", "third"}
+	jobs := make([]sqsSendJob, len(bodies))
+	for i, body := range bodies {
+		jobs[i] = sqsSendJob{ctx: context.Background(), message: map[string]string{"body": body}, fullUrl: body, clientID: "client", result: make(chan error, 1)}
+	}
+	sendSQSBatch(jobs)
+
+	if len(*calls) != 1 || (*calls)[0] != len(bodies) {
+		t.Fatalf("SendMessageBatch calls = %v, want one call with %d entries", *calls, len(bodies))
+	}
+	for i, job := range jobs {
+		err := <-job.result
+		if rejected := strings.Contains(bodies[i], "reject"); rejected != (err != nil) {
+			t.Errorf("entry %q: err = %v, want failure %t", bodies[i], err, rejected)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// stateStore persists the run state the resume logic depends on: the
+// cursors (last_processed_date, and last_sync_time in MODE=continuous) and
+// the sets that record skipped or flagged
+// dates, patients and encounters. STATE_STORE selects Redis (default) or
+// local files, so small jobs can run without Redis.
+type stateStore interface {
+	// GetCursor returns "" when the cursor was never set.
+	GetCursor(ctx context.Context, name string) (string, error)
+	SetCursor(ctx context.Context, name string, value string) error
+	AddToSet(ctx context.Context, set string, members ...string) error
+	Describe(ctx context.Context) (string, error)
+}
+
+var state stateStore = redisStateStore{}
+
+func initStateStore() {
+	if cfg.StateStore == "file" {
+		state = &fileStateStore{dir: cfg.StateDir, sets: map[string]map[string]bool{}}
+	}
+	if cfg.ReadOnly {
+		state = readOnlyStateStore{state}
+	}
+}
+
+type redisStateStore struct{}
+
+func (redisStateStore) GetCursor(ctx context.Context, name string) (string, error) {
+	value, err := redisRetry(ctx, "get "+name, func() (string, error) {
+		return redisClient.Get(ctx, name).Result()
+	})
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return value, err
+}
+
+func (redisStateStore) SetCursor(ctx context.Context, name string, value string) error {
+	_, err := redisRetry(ctx, "set "+name, func() (string, error) {
+		return redisClient.Set(ctx, name, value, 0).Result()
+	})
+	return err
+}
+
+func (redisStateStore) AddToSet(ctx context.Context, set string, members ...string) error {
+	_, err := redisRetry(ctx, "sadd "+set, func() (int64, error) {
+		return redisClient.SAdd(ctx, set, stringsToAny(members)...).Result()
+	})
+	return err
+}
+
+func (redisStateStore) Describe(ctx context.Context) (string, error) {
+	if err := redisClient.Ping(ctx).Err(); err != nil {
+		return "", fmt.Errorf("pinging %s: %w", redisClient.Options().Addr, err)
+	}
+	return redisClient.Options().Addr + " reachable", nil
+}
+
+// fileStateStore keeps each cursor in STATE_DIR/<name> and each
+// set in STATE_DIR/<set>.txt, one member per line. A set file is read once
+// and then only appended to, skipping members already present.
+type fileStateStore struct {
+	dir  string
+	mu   sync.Mutex
+	sets map[string]map[string]bool
+}
+
+func (s *fileStateStore) GetCursor(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading cursor file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SetCursor writes through a temporary file so a crash never leaves a
+// truncated cursor.
+func (s *fileStateStore) SetCursor(ctx context.Context, name string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("error creating state dir: %w", err)
+	}
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path+".tmp", []byte(value+"\n"), 0o644); err != nil {
+		return fmt.Errorf("error writing cursor file: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *fileStateStore) AddToSet(ctx context.Context, set string, members ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.dir, set+".txt")
+	existing, err := s.loadSet(set, path)
+	if err != nil {
+		return err
+	}
+	var added []string
+	for _, member := range members {
+		if !existing[member] {
+			existing[member] = true
+			added = append(added, member)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("error creating state dir: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(strings.Join(added, "\n") + "\n"); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *fileStateStore) loadSet(set string, path string) (map[string]bool, error) {
+	if members, ok := s.sets[set]; ok {
+		return members, nil
+	}
+	members := map[string]bool{}
+	file, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				members[line] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", path, err)
+		}
+	}
+	s.sets[set] = members
+	return members, nil
+}
+
+func (s *fileStateStore) Describe(ctx context.Context) (string, error) {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating state dir: %w", err)
+	}
+	return "state files in " + s.dir, nil
+}
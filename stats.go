@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// runStats accumulates the outcome of a run for the machine-readable summary
+// written by writeRunStats. It is updated concurrently by encounter workers.
+type runStats struct {
+	mu sync.Mutex
+
+	RunID              string         `json:"runId"`
+	Mode               string         `json:"mode"`
+	StartedAt          time.Time      `json:"startedAt"`
+	FinishedAt         time.Time      `json:"finishedAt"`
+	RuntimeSeconds     float64        `json:"runtimeSeconds"`
+	DatesProcessed     int            `json:"datesProcessed"`
+	DatesFailed        int            `json:"datesFailed"`
+	PatientsProcessed  int            `json:"patientsProcessed"`
+	PatientsFailed     int            `json:"patientsFailed"`
+	EncountersSeen     int            `json:"encountersSeen"`
+	EncountersSent     int            `json:"encountersSent"`
+	EncountersFiltered int            `json:"encountersFiltered"`
+	DuplicateEntries   int            `json:"duplicateEntries"`
+	AlreadySent        int            `json:"alreadySent,omitempty"`
+	OutsideDate        int            `json:"outsideDate,omitempty"`
+	Polls              int            `json:"polls,omitempty"`
+	Flagged            map[string]int `json:"flagged"`
+	AbortReason        string         `json:"abortReason,omitempty"`
+	ExitCode           int            `json:"exitCode"`
+}
+
+var stats = &runStats{StartedAt: time.Now(), Flagged: map[string]int{}}
+
+func (s *runStats) update(apply func(s *runStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apply(s)
+}
+
+// flagEncounter adds an encounter to one of the Redis sets that track
+// skipped or suspicious encounters and counts it under that set's name.
+func flagEncounter(ctx context.Context, set string, fullUrl string) {
+	stats.update(func(s *runStats) { s.Flagged[set]++ })
+	if set == "invalid_encounters" {
+		checkInvalidRate()
+	}
+	if err := state.AddToSet(ctx, set, fullUrl); err != nil {
+		slog.Error("Error adding to "+set, "error", err)
+	}
+}
+
+// writeRunStats marshals the summary to STATS_FILE, or to stdout when unset.
+// Logs go to stderr, so stdout carries nothing but the JSON.
+func writeRunStats() {
+	stats.update(func(s *runStats) {
+		s.RunID = runID
+		s.Mode = cfg.Mode
+		s.FinishedAt = time.Now()
+		s.RuntimeSeconds = s.FinishedAt.Sub(s.StartedAt).Seconds()
+		if err := runAborted(); err != nil {
+			s.AbortReason = err.Error()
+		}
+	})
+
+	stats.mu.Lock()
+	data, err := json.Marshal(stats)
+	stats.mu.Unlock()
+	if err != nil {
+		slog.Error("Error encoding run stats", "error", err)
+		return
+	}
+
+	if cfg.StatsFile == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := os.WriteFile(cfg.StatsFile, append(data, '\n'), 0o644); err != nil {
+		slog.Error("Error writing run stats", "file", cfg.StatsFile, "error", err)
+	}
+}
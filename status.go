@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// encounterStatuses is the FHIR R4 Encounter.status value set.
+var encounterStatuses = map[string]bool{
+	"planned":          true,
+	"arrived":          true,
+	"triaged":          true,
+	"in-progress":      true,
+	"onleave":          true,
+	"finished":         true,
+	"cancelled":        true,
+	"entered-in-error": true,
+	"unknown":          true,
+}
+
+var statusMapping map[string]string
+
+// parseStatusMapping reads STATUS_MAPPING in the form "finished=completed,in-progress=active".
+func parseStatusMapping(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+	if value == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		from, to, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid STATUS_MAPPING entry %q, expected from=to", pair)
+		}
+		if !encounterStatuses[from] {
+			return nil, fmt.Errorf("STATUS_MAPPING maps %q, which is not a FHIR Encounter status", from)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+// normalizeStatus flags statuses outside the FHIR value set and applies the
+// configured mapping. Unknown statuses are passed through unmapped.
+func normalizeStatus(ctx context.Context, status string, fullUrl string) string {
+	if !encounterStatuses[status] {
+		slog.Warn("Encounter status outside the FHIR value set", "status", status, "fullUrl", fullUrl)
+		flagEncounter(ctx, "unknown_status_encounters", fullUrl)
+		return status
+	}
+
+	if mapped, ok := statusMapping[status]; ok {
+		return mapped
+	}
+	return status
+}
+
+// statusIncluded applies INCLUDE_STATUSES and EXCLUDE_STATUSES to the raw
+// FHIR status, before STATUS_MAPPING. An empty include list admits every
+// status not excluded.
+func statusIncluded(status string) bool {
+	if include := cfg.IncludeStatusList(); len(include) > 0 && !slices.Contains(include, status) {
+		return false
+	}
+	return !slices.Contains(cfg.ExcludeStatusList(), status)
+}
+
+func validateStatusList(name string, statuses []string) error {
+	for _, status := range statuses {
+		if !encounterStatuses[status] {
+			return fmt.Errorf("%s lists %q, which is not a FHIR Encounter status", name, status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// summaryComplete reports whether an Encounter returned under ENCOUNTER_SUMMARY
+// still carries every field the parser needs. Servers differ on what goes in
+// a summary (participant is not a summary element in R4), so this is checked
+// per entry rather than assumed.
+func summaryComplete(enc Encounter) bool {
+	return enc.Status != "" && enc.Class.Code != "" && !enc.Period.Start.IsZero() &&
+		enc.Participant != nil && enc.Subject.Reference != ""
+}
+
+// fetchFullEncounter reads an Encounter without _summary, used when the
+// summarized search entry lacks required fields.
+func fetchFullEncounter(ctx context.Context, base string, id string) (Encounter, error) {
+	encounterURL := withElements(fmt.Sprintf("%s/Encounter/%s", base, id), cfg.EncounterElements)
+	slog.Debug("Summary incompleto, buscando encontro completo", "url", encounterURL)
+	data, err := fetchDataWithRetry(ctx, encounterURL, cfg.FetchMaxRetries)
+	if err != nil {
+		return Encounter{}, err
+	}
+
+	var enc Encounter
+	if err := fastJSON.Unmarshal(data, &enc); err != nil {
+		return Encounter{}, fmt.Errorf("erro ao parsear JSON do encontro: %w: %v", errResponseParse, err)
+	}
+	if enc.ID != id {
+		return Encounter{}, errReferenceMismatch
+	}
+	return enc, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import "time"
+
+// The to*DB functions map parsed FHIR resources to the message structs. They
+// do no I/O, so status normalization, PractitionerRole lookup and caching
+// stay with their callers.
+
+func toEncounterDB(enc Encounter, fullUrl string, practitionerId string, patientId string) EncounterDB {
+	encParsed := EncounterDB{
+		FhirId:  enc.ID,
+		FullUrl: fullUrl,
+		Status:  enc.Status,
+		Class:   enc.Class.Code,
+		Period: Period{
+			Start: enc.Period.Start.Time,
+			End:   enc.Period.End.Time,
+		},
+		PractitionerId: practitionerId,
+		PatientId:      patientId,
+	}
+	if len(enc.Type) > 0 {
+		if coding, ok := enc.Type[0].FirstCoding(); ok {
+			encParsed.TypeSystem = coding.System
+			encParsed.TypeCode = coding.Code
+			encParsed.TypeDisplay = coding.Display
+		}
+	}
+	encParsed.LastUpdated = lastUpdated(enc.Meta.LastUpdated)
+	return encParsed
+}
+
+// setParticipant records the role and period of the participant chosen as
+// the practitioner. Unparseable participant period values are left out.
+func setParticipant(encParsed *EncounterDB, participant EncounterParticipant) {
+	if coding, ok := participant.Role(); ok {
+		encParsed.ParticipantTypeSystem = coding.System
+		encParsed.ParticipantTypeCode = coding.Code
+		encParsed.ParticipantTypeDisplay = coding.Display
+	}
+	if !participant.Period.Start.IsZero() || !participant.Period.End.IsZero() {
+		encParsed.ParticipantPeriod = &Period{Start: participant.Period.Start.Time, End: participant.Period.End.Time}
+	}
+}
+
+// periodLocation is PERIOD_TIMEZONE; nil keeps the offsets the server sent.
+var periodLocation *time.Location
+
+// normalizePeriod converts both ends of a period to location, optionally
+// recording the offset each was received with. Open ends stay zero.
+func normalizePeriod(period Period, location *time.Location, keepOffset bool) Period {
+	normalized := Period{}
+	if !period.Start.IsZero() {
+		normalized.Start = period.Start.In(location)
+		if keepOffset {
+			normalized.StartOffset = period.Start.Format("-07:00")
+		}
+	}
+	if !period.End.IsZero() {
+		normalized.End = period.End.In(location)
+		if keepOffset {
+			normalized.EndOffset = period.End.Format("-07:00")
+		}
+	}
+	return normalized
+}
+
+// toPractitionerDB expects a practitioner already checked to have a given
+// name.
+func toPractitionerDB(practitioner Practitioner) PractitionerDB {
+	practitionerParsed := PractitionerDB{
+		FhirId:     practitioner.ID,
+		GivenName:  practitioner.Name[0].Given[0],
+		FamilyName: practitioner.Name[0].Family,
+	}
+	if len(practitioner.Qualification) > 0 {
+		if coding, ok := practitioner.Qualification[0].Code.FirstCoding(); ok {
+			practitionerParsed.QualificationCode = coding.Code
+			practitionerParsed.QualificationDisplay = coding.Display
+		}
+	}
+	practitionerParsed.LastUpdated = lastUpdated(practitioner.Meta.LastUpdated)
+	return practitionerParsed
+}
+
+// toPatientDB expects a patient already checked to have a given name.
+func toPatientDB(patient Patient) PatientDB {
+	patientParsed := PatientDB{
+		FhirId:     patient.ID,
+		GivenName:  patient.Name[0].Given[0],
+		FamilyName: patient.Name[0].Family,
+		BirthDate:  patient.BirthDate,
+		Gender:     patient.Gender,
+
+		ManagingOrganization: patient.ManagingOrganization.Reference,
+	}
+	if address, ok := patient.PreferredAddress(); ok {
+		patientParsed.City = address.City
+		patientParsed.State = address.State
+		patientParsed.PostalCode = address.PostalCode
+		patientParsed.Country = address.Country
+	}
+	if cfg.CaptureTelecom {
+		patientParsed.Phone, patientParsed.Email = patient.PreferredContacts()
+	}
+	patientParsed.Deceased, patientParsed.DeceasedDateTime = patient.DeceasedStatus()
+	patientParsed.LastUpdated = lastUpdated(patient.Meta.LastUpdated)
+	return patientParsed
+}
+
+// lastUpdated parses a meta.lastUpdated for CAPTURE_LAST_UPDATED. A missing
+// or unparseable value leaves the field out rather than rejecting the
+// resource.
+func lastUpdated(raw string) *time.Time {
+	if !cfg.CaptureLastUpdated || raw == "" {
+		return nil
+	}
+	for _, layout := range fhirDateTimeLayouts {
+		if parsed, err := time.Parse(layout, raw); err == nil {
+			return &parsed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// largeBundleFixture is a 1000-entry Encounter searchset shaped like a
+// HAPI response; bundleOfSize repeats its entries to reach other sizes.
+const largeBundleFixture = "testdata/encounter_bundle_1000.json"
+
+var benchmarkBundleSizes = []int{10, 1000, 10000}
+
+// bundleOfSize returns a Bundle body with n entries taken in turn from the
+// fixture.
+func bundleOfSize(tb testing.TB, n int) []byte {
+	tb.Helper()
+	data, err := os.ReadFile(largeBundleFixture)
+	if err != nil {
+		tb.Fatalf("reading fixture: %v", err)
+	}
+	var bundle map[string]json.RawMessage
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		tb.Fatalf("parsing fixture: %v", err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(bundle["entry"], &entries); err != nil {
+		tb.Fatalf("parsing fixture entries: %v", err)
+	}
+
+	sized := make([]json.RawMessage, n)
+	for i := range sized {
+		sized[i] = entries[i%len(entries)]
+	}
+	bundle["entry"], _ = json.Marshal(sized)
+	bundle["total"], _ = json.Marshal(n)
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		tb.Fatalf("building bundle: %v", err)
+	}
+	return body
+}
+
+// fixtureEncounter is the fixture's first Encounter.
+func fixtureEncounter(tb testing.TB) BundleEntry {
+	tb.Helper()
+	var bundle Bundle
+	if err := json.Unmarshal(bundleOfSize(tb, 1), &bundle); err != nil {
+		tb.Fatalf("decoding bundle: %v", err)
+	}
+	return bundle.Entry[0]
+}
+
+func benchmarkPatient() Patient {
+	var patient Patient
+	json.Unmarshal([]byte(`{
+		"resourceType": "Patient",
+		"id": "5000",
+		"name": [{"family": "Silva", "given": ["Maria", "Clara"]}],
+		"birthDate": "1984-03-02",
+		"gender": "female",
+		"managingOrganization": {"reference": "Organization/300"},
+		"address": [
+			{"use": "old", "city": "Recife", "state": "PE", "postalCode": "50000-000", "country": "BR"},
+			{"use": "home", "city": "Olinda", "state": "PE", "postalCode": "53000-000", "country": "BR"}
+		],
+		"deceasedBoolean": false
+	}`), &patient)
+	return patient
+}
+
+func BenchmarkToEncounterDB(b *testing.B) {
+	entry := fixtureEncounter(b)
+	enc := entry.Resource
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		toEncounterDB(enc, entry.FullUrl, "2000", "5000")
+	}
+}
+
+func BenchmarkToPatientDB(b *testing.B) {
+	patient := benchmarkPatient()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		toPatientDB(patient)
+	}
+}
+
+func BenchmarkExtractReferenceID(b *testing.B) {
+	refs := []string{
+		"Patient/5000",
+		"http://hapi.fhir.org/baseR4/Practitioner/2000",
+		"5000",
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		extractReferenceID(refs[i%len(refs)])
+	}
+}
+
+func BenchmarkBundleUnmarshal(b *testing.B) {
+	for _, size := range benchmarkBundleSizes {
+		body := bundleOfSize(b, size)
+		b.Run(fmt.Sprintf("entries=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var bundle Bundle
+				if err := fastJSON.Unmarshal(body, &bundle); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decodePatient(t *testing.T, extra string) Patient {
+	t.Helper()
+	var patient Patient
+	body := `{"resourceType": "Patient", "id": "5000", "name": [{"family": "Silva", "given": ["Maria"]}]` + extra + `}`
+	if err := json.Unmarshal([]byte(body), &patient); err != nil {
+		t.Fatalf("decoding patient: %v", err)
+	}
+	return patient
+}
+
+func TestToPatientDBDeceased(t *testing.T) {
+	tests := []struct {
+		name         string
+		extra        string
+		wantDeceased bool
+		wantDateTime string
+	}{
+		{name: "absent", extra: "", wantDeceased: false},
+		{name: "boolean true", extra: `, "deceasedBoolean": true`, wantDeceased: true},
+		{name: "boolean false", extra: `, "deceasedBoolean": false`, wantDeceased: false},
+		{name: "dateTime", extra: `, "deceasedDateTime": "2023-11-04T10:30:00-03:00"`, wantDeceased: true, wantDateTime: "2023-11-04T10:30:00-03:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := toPatientDB(decodePatient(t, tt.extra))
+			if parsed.Deceased != tt.wantDeceased || parsed.DeceasedDateTime != tt.wantDateTime {
+				t.Fatalf("deceased = %t, %q; want %t, %q", parsed.Deceased, parsed.DeceasedDateTime, tt.wantDeceased, tt.wantDateTime)
+			}
+		})
+	}
+}
+
+func TestToEncounterDBType(t *testing.T) {
+	tests := []struct {
+		name        string
+		typeJSON    string
+		wantSystem  string
+		wantCode    string
+		wantDisplay string
+	}{
+		{
+			name: "populated",
+			typeJSON: `, "type": [
+				{"coding": [
+					{"system": "http://snomed.info/sct", "code": "185349003", "display": "Encounter for check up"},
+					{"system": "http://example.org/local", "code": "CHK", "display": "Checkup"}
+				]},
+				{"coding": [{"system": "http://snomed.info/sct", "code": "50849002", "display": "Emergency room admission"}]}
+			]`,
+			wantSystem:  "http://snomed.info/sct",
+			wantCode:    "185349003",
+			wantDisplay: "Encounter for check up",
+		},
+		{name: "empty", typeJSON: `, "type": []`},
+		{name: "without coding", typeJSON: `, "type": [{"text": "Consulta"}]`},
+		{name: "missing", typeJSON: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var enc Encounter
+			body := `{"resourceType": "Encounter", "id": "100000", "status": "finished", "class": {"code": "AMB"}` + tt.typeJSON + `}`
+			if err := json.Unmarshal([]byte(body), &enc); err != nil {
+				t.Fatalf("decoding encounter: %v", err)
+			}
+			parsed := toEncounterDB(enc, "http://fhir/Encounter/100000", "2000", "5000")
+			if parsed.TypeSystem != tt.wantSystem || parsed.TypeCode != tt.wantCode || parsed.TypeDisplay != tt.wantDisplay {
+				t.Fatalf("type = %q %q %q, want %q %q %q",
+					parsed.TypeSystem, parsed.TypeCode, parsed.TypeDisplay, tt.wantSystem, tt.wantCode, tt.wantDisplay)
+			}
+		})
+	}
+}
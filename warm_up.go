@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// warmUpPractitioners (WARM_UP_PRACTITIONERS) reads every Practitioner of
+// the server, WARM_UP_PAGE_SIZE per page, and stores each valid one in the
+// reference cache before any date is processed, so facilities with few
+// practitioners resolve almost all of them from Redis. A failure only ends
+// the warm-up early: whatever is missing is fetched per encounter as usual.
+func warmUpPractitioners(ctx context.Context) {
+	base := activeFHIRBase()
+	pageURL := withElements(withParam(base+"/Practitioner", "_count", strconv.Itoa(cfg.WarmUpPageSize)), cfg.PractitionerElements)
+	slog.Info("Preloading practitioners into the reference cache", "url", pageURL)
+
+	started := time.Now()
+	cached, invalid, pages := 0, 0, 0
+	for pageURL != "" {
+		if cfg.MaxPages > 0 && pages >= cfg.MaxPages {
+			slog.Warn("MAX_PAGES reached, practitioner warm-up incomplete", "pages", pages)
+			break
+		}
+		data, pageBase, err := retryFetchFailover(ctx, pageURL, cfg.FetchMaxRetries, fetchData)
+		if err != nil {
+			slog.Error("Error fetching practitioners, warm-up incomplete", "url", pageURL, "error", err)
+			break
+		}
+		if pageBase == "" {
+			pageBase = base
+		}
+		var bundle Bundle
+		if err := fastJSON.Unmarshal(data, &bundle); err != nil {
+			slog.Error("Error parsing practitioner bundle, warm-up incomplete", "url", pageURL, "error", fmt.Errorf("%w: %v", errResponseParse, err))
+			break
+		}
+
+		for _, entry := range bundle.Entry {
+			if entry.Practitioner == nil {
+				continue
+			}
+			reference := "Practitioner/" + entry.Practitioner.ID
+			practitioner, err := parsePractitioner(ctx, pageBase, reference, *entry.Practitioner)
+			if err != nil {
+				invalid++
+				continue
+			}
+			storeCachedReference(ctx, reference, practitioner)
+			cached++
+		}
+		pages++
+		pageURL = bundle.NextLink()
+	}
+	slog.Info("Practitioner warm-up finished", "cached", cached, "invalid", invalid, "pages", pages, "duration", time.Since(started).Round(time.Millisecond))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var errDateStalled = errors.New("no encounter completed within STALL_TIMEOUT")
+
+var stalledDatesTotal = expvar.NewInt("stalled_dates_total")
+
+// stallWatchdog watches the date in progress: when no encounter completes
+// for STALL_TIMEOUT it logs the requests in flight and, with
+// STALL_ACTION=retry, cancels the date so runDateRange retries it. This
+// catches a worker wedged on a request the client timeout did not end.
+type stallWatchdog struct {
+	mu           sync.Mutex
+	date         string
+	cancel       context.CancelCauseFunc
+	lastProgress time.Time
+}
+
+var watchdog = &stallWatchdog{}
+
+// Begin marks date as in progress and returns the context to process it
+// with, which the watchdog may cancel, and the function that ends the watch.
+func (w *stallWatchdog) Begin(ctx context.Context, date string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w.mu.Lock()
+	w.date, w.cancel, w.lastProgress = date, cancel, time.Now()
+	w.mu.Unlock()
+	return ctx, func() {
+		w.mu.Lock()
+		w.date, w.cancel = "", nil
+		w.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// Progress records that an encounter completed.
+func (w *stallWatchdog) Progress() {
+	w.mu.Lock()
+	w.lastProgress = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *stallWatchdog) check(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel == nil || now.Sub(w.lastProgress) < cfg.StallTimeout {
+		return
+	}
+
+	stalledDatesTotal.Add(1)
+	slog.Warn("Processamento parado: nenhum encontro concluído dentro de STALL_TIMEOUT",
+		"date", w.date, "since", w.lastProgress, "action", cfg.StallAction, "requestsInFlight", fhirRequests.List())
+	if cfg.StallAction == "retry" {
+		w.cancel(errDateStalled)
+		w.cancel = nil
+		return
+	}
+	// Warn again only after another full STALL_TIMEOUT without progress.
+	w.lastProgress = now
+}
+
+// startWatchdog checks for stalls a few times per STALL_TIMEOUT until the
+// returned function is called.
+func startWatchdog(timeout time.Duration) func() {
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(max(timeout/4, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				watchdog.check(now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}